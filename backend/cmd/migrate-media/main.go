@@ -0,0 +1,99 @@
+// Command migrate-media copies the media files from one storage backend to
+// another, e.g. from the local disk to an S3 bucket:
+//
+//	go run ./cmd/migrate-media -from local -to s3
+//
+// Both backends are configured with the same environment variables as the
+// server (STORAGE_LOCAL_ROOT, S3_*). Files already present in the destination
+// with the same size are skipped, so an interrupted run can be restarted.
+// Keys don't change, so the recipes need no update: switch STORAGE_BACKEND
+// once the copy is complete.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"xgastroteca/storage"
+)
+
+func main() {
+	from := flag.String("from", "local", "source backend (local or s3)")
+	to := flag.String("to", "s3", "destination backend (local or s3)")
+	prefix := flag.String("prefix", "videos/", "only migrate keys starting with this prefix")
+	deleteSource := flag.Bool("delete", false, "remove each file from the source once copied")
+	dryRun := flag.Bool("dry-run", false, "list what would be copied without writing anything")
+	flag.Parse()
+
+	if *from == *to {
+		log.Fatal("Source and destination backends are the same")
+	}
+
+	src, err := storage.New(*from)
+	if err != nil {
+		log.Fatalf("Failed to open source store: %v", err)
+	}
+	dst, err := storage.New(*to)
+	if err != nil {
+		log.Fatalf("Failed to open destination store: %v", err)
+	}
+
+	ctx := context.Background()
+	objects, err := src.List(ctx, *prefix)
+	if err != nil {
+		log.Fatalf("Failed to list source files: %v", err)
+	}
+	log.Printf("Migrating %d files from %s to %s", len(objects), *from, *to)
+
+	var copied, skipped, failed int
+	var bytes int64
+	for _, obj := range objects {
+		if existing, err := dst.Stat(ctx, obj.Key); err == nil && existing.Size == obj.Size {
+			skipped++
+			if *deleteSource && !*dryRun {
+				src.Delete(ctx, obj.Key)
+			}
+			continue
+		}
+
+		if *dryRun {
+			log.Printf("Would copy %s (%d bytes)", obj.Key, obj.Size)
+			copied++
+			bytes += obj.Size
+			continue
+		}
+
+		if err := copyObject(ctx, src, dst, obj); err != nil {
+			log.Printf("Failed to copy %s: %v", obj.Key, err)
+			failed++
+			continue
+		}
+		copied++
+		bytes += obj.Size
+
+		if *deleteSource {
+			if err := src.Delete(ctx, obj.Key); err != nil {
+				log.Printf("Copied %s but failed to remove it from the source: %v", obj.Key, err)
+			}
+		}
+	}
+
+	log.Printf("Done: %d copied (%d MB), %d already present, %d failed", copied, bytes>>20, skipped, failed)
+	if failed > 0 {
+		log.Fatal("Some files were not migrated, run the command again")
+	}
+}
+
+func copyObject(ctx context.Context, src, dst storage.MediaStore, obj storage.ObjectInfo) error {
+	body, err := src.Get(ctx, obj.Key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	contentType := obj.ContentType
+	if contentType == "" {
+		contentType = storage.ContentType(obj.Key)
+	}
+	return dst.Put(ctx, obj.Key, body, obj.Size, contentType)
+}
@@ -26,9 +26,23 @@ func InitDB() {
 		&models.Step{},
 		&models.Tag{},
 		&models.ProcessingJob{},
+		&models.AIUsageRecord{},
+		&models.RecipeSource{},
+		&models.AIResponseCache{},
+		&models.RecipeTranslation{},
+		&models.SubstitutionCache{},
+		&models.UploadSession{},
+		&models.RecipeTombstone{},
 	)
 	if err != nil {
 		log.Fatal("Failed to migrate database:", err)
 	}
+
+	// The unique index of recipes includes the part now (videos with several recipes)
+	if DB.Migrator().HasIndex(&models.Recipe{}, "idx_source_id") {
+		if err := DB.Migrator().DropIndex(&models.Recipe{}, "idx_source_id"); err != nil {
+			log.Fatal("Failed to drop old recipe index:", err)
+		}
+	}
 	log.Println("Database migration completed.")
 }
@@ -1,17 +1,25 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"math"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 	"xgastroteca/database"
 	"xgastroteca/models"
 	"xgastroteca/services"
+	"xgastroteca/storage"
 	"xgastroteca/utils"
 
 	"github.com/gin-contrib/cors"
@@ -22,14 +30,75 @@ type ProcessRequest struct {
 	URL string `json:"url" binding:"required"`
 }
 
+// ProcessResponse is the first recipe of a processed video, with every
+// recipe of the video in Parts when it has several.
+type ProcessResponse struct {
+	*models.Recipe
+	Parts []models.Recipe `json:"parts,omitempty"`
+}
+
+type CreateUploadRequest struct {
+	Filename string `json:"filename"`
+	MimeType string `json:"mime_type" binding:"required"`
+	Size     int64  `json:"size" binding:"required"`
+}
+
 type AddTagRequest struct {
 	Name string `json:"name" binding:"required"`
 }
 
+type IngredientMatchRequest struct {
+	IngredientID uint     `json:"ingredient_id" binding:"required"`
+	Food         string   `json:"food"`  // Nutrient table key, "" to mark as not countable
+	Grams        *float64 `json:"grams"` // nil to keep the automatic estimation
+	Reset        bool     `json:"reset"` // Back to automatic matching
+}
+
+type CreateVariantRequest struct {
+	Title         string                         `json:"title"`
+	Substitutions []services.VariantSubstitution `json:"substitutions" binding:"required,min=1,dive"`
+}
+
+type TranslateRequest struct {
+	Language string `json:"language" binding:"required"`
+	Refresh  bool   `json:"refresh"`
+}
+
+type DietaryOverrideRequest struct {
+	Allergens  []string `json:"allergens"`
+	Vegetarian bool     `json:"vegetarian"`
+	Vegan      bool     `json:"vegan"`
+}
+
+type MediaCheckRequest struct {
+	Action string `json:"action" binding:"required,oneof=report quarantine delete"`
+}
+
+type RecipeStatusRequest struct {
+	Cooked   *bool `json:"cooked"`
+	Archived *bool `json:"archived"`
+}
+
+type RegenerateThumbnailsRequest struct {
+	All bool `json:"all"`
+}
+
+type JanitorRequest struct {
+	DryRun bool `json:"dry_run"`
+}
+
+type SyncRequest struct {
+	Changes []services.RecipeEdit `json:"changes" binding:"required,dive"`
+}
+
+type UpdateNutritionRequest struct {
+	Servings    *int                     `json:"servings"`
+	Ingredients []IngredientMatchRequest `json:"ingredients"`
+}
+
 func main() {
 	// Ensure data directory exists
-	dataPath := "./data/videos"
-	if err := os.MkdirAll(dataPath, 0755); err != nil {
+	if err := os.MkdirAll(storage.WorkPath("videos"), 0755); err != nil {
 		log.Fatalf("Failed to create data directory: %v", err)
 	}
 
@@ -41,26 +110,73 @@ func main() {
 	// Initialize Database
 	database.InitDB()
 
+	// Media store (local disk or S3 compatible bucket)
+	storage.InitStorage()
+
 	// Migration: Populate SearchText for existing recipes
 	var allRecipes []models.Recipe
 	database.DB.Find(&allRecipes)
 	for _, r := range allRecipes {
-		database.DB.Save(&r)
+		previous := r.SearchText
+		if r.UpdateSearchText(); r.SearchText != previous {
+			// Without touching UpdatedAt, syncing clients would download everything again
+			database.DB.Model(&r).UpdateColumn("search_text", r.SearchText)
+		}
 	}
 
+	// Migration: Dietary flags for recipes created before the classifier
+	services.ClassifyPendingRecipes()
+
+	// Migration: Nutrition for recipes created before it was estimated
+	services.ComputePendingNutrition()
+
+	// Migration: Original language for recipes created before it was stored
+	services.DetectPendingLanguages()
+
+	// Migration: Source hash of the translations cached before it was stored
+	services.AdoptLegacyTranslations()
+
+	// Migration: Canonical URL for recipes created before it was stored
+	services.CanonicalizePendingRecipes()
+
+	// Migration: Media paths stored as "data/videos/..." by the first versions
+	services.NormalizeMediaPaths()
+
+	// Migration: Resized thumbnails for recipes created before them (in the background, it decodes every image)
+	go services.GeneratePendingThumbnails(false)
+
+	// Forget deletions older than SYNC_TOMBSTONE_DAYS
+	services.PruneTombstones()
+
+	// Remove resumable uploads abandoned by their clients (now and every hour)
+	services.StartUploadCleaner()
+
+	// Cancelled on shutdown, stopping the queued job being processed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Start Queue Worker
-	services.StartQueueWorker()
+	services.StartQueueWorker(ctx)
+
+	// Periodic check of orphaned and missing media files
+	services.StartMediaChecker()
+
+	// Retention policies (quota, video age, archived recipes)
+	services.StartJanitor()
 
 	r := gin.Default()
 
 	// CORS Configuration
 	r.Use(cors.New(cors.Config{
 		AllowAllOrigins: true,
-		AllowMethods:    []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:    []string{"Origin", "Content-Type"},
+		AllowMethods:    []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:    []string{"Origin", "Content-Type", "Upload-Offset"},
+		ExposeHeaders:   []string{"Upload-Offset"},
 	}))
 
-	r.Static("/videos", "./data/videos")
+	// Media files: served from disk, or redirected to a signed URL of the bucket
+	r.GET("/videos/*filepath", serveMedia)
+	r.HEAD("/videos/*filepath", serveMedia)
 
 	// --- ROUTES ---
 
@@ -73,39 +189,110 @@ func main() {
 		}
 
 		// Call the shared processor service
-		recipe, err := services.ProcessVideo(req.URL)
+		recipe, err := services.ProcessVideo(c.Request.Context(), req.URL)
+		respondProcessResult(c, req.URL, recipe, err)
+	})
+
+	// POST /api/process/upload - Process a video file sent as multipart "file"
+	r.POST("/api/process/upload", func(c *gin.Context) {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, services.UploadMaxBytes()+1<<20)
+		header, err := c.FormFile("file")
 		if err != nil {
-			// Check for Quota Error / Rate Limit
-			if strings.Contains(err.Error(), "429") || strings.Contains(strings.ToLower(err.Error()), "quota") {
-				// Queue the job
-				job := models.ProcessingJob{
-					URL:         req.URL,
-					Status:      models.JobStatusPending,
-					NextRetryAt: time.Now().Add(15 * time.Minute),
-					ErrorMsg:    "Initial Quota Exceeded",
-				}
-				database.DB.Create(&job)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing video file", "details": err.Error()})
+			return
+		}
 
-				c.JSON(http.StatusAccepted, gin.H{
-					"message":  "Quota exceeded. Added to processing queue.",
-					"queue_id": job.ID,
-					"status":   "queued",
-				})
-				return
-			}
+		fullPath, err := services.SaveUploadedFile(header)
+		if err != nil {
+			respondUploadError(c, err)
+			return
+		}
 
-			// Check for "Not a Recipe"
-			if err.Error() == "not_a_recipe" {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Video is not a food recipe", "code": "NOT_A_RECIPE"})
-				return
-			}
+		recipe, err := services.ProcessUploadedVideo(fullPath)
+		respondProcessResult(c, services.UploadJobURL(fullPath), recipe, err)
+	})
 
-			// General Error
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process video", "details": err.Error()})
+	// POST /api/uploads - Start a resumable upload
+	r.POST("/api/uploads", func(c *gin.Context) {
+		var req CreateUploadRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		c.JSON(http.StatusOK, recipe)
+		session, err := services.CreateUploadSession(req.Filename, req.MimeType, req.Size)
+		if err != nil {
+			respondUploadError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"upload_id":  session.UploadID,
+			"offset":     session.Offset,
+			"size":       session.Size,
+			"chunk_size": services.UploadChunkSize,
+		})
+	})
+
+	// GET /api/uploads/:id - Bytes received so far, to resume an interrupted upload
+	r.GET("/api/uploads/:id", func(c *gin.Context) {
+		session, err := services.FindUploadSession(c.Param("id"))
+		if err != nil {
+			respondUploadError(c, err)
+			return
+		}
+		c.Header("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+		c.JSON(http.StatusOK, session)
+	})
+
+	// PATCH /api/uploads/:id - Append a raw chunk at the offset given in the Upload-Offset header
+	r.PATCH("/api/uploads/:id", func(c *gin.Context) {
+		session, err := services.FindUploadSession(c.Param("id"))
+		if err != nil {
+			respondUploadError(c, err)
+			return
+		}
+
+		offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Offset header"})
+			return
+		}
+
+		newOffset, err := services.AppendUploadChunk(session, offset, c.Request.Body)
+		c.Header("Upload-Offset", strconv.FormatInt(newOffset, 10))
+		if err != nil {
+			respondUploadError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"upload_id": session.UploadID, "offset": newOffset, "size": session.Size})
+	})
+
+	// POST /api/uploads/:id/complete - Finish a resumable upload and process the video
+	r.POST("/api/uploads/:id/complete", func(c *gin.Context) {
+		session, err := services.FindUploadSession(c.Param("id"))
+		if err != nil {
+			respondUploadError(c, err)
+			return
+		}
+
+		fullPath, err := services.FinishUpload(session)
+		if err != nil {
+			respondUploadError(c, err)
+			return
+		}
+
+		recipe, err := services.ProcessUploadedVideo(fullPath)
+		respondProcessResult(c, services.UploadJobURL(fullPath), recipe, err)
+	})
+
+	// GET /api/sources - Supported video platforms (any other page is imported as a web recipe)
+	r.GET("/api/sources", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"sources":   utils.Sources(),
+			"web_pages": true,
+		})
 	})
 
 	// GET /api/queue - List pending jobs
@@ -149,49 +336,413 @@ func main() {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add tag"})
 			return
 		}
+		services.TouchRecipe(recipe.ID)
 
 		c.JSON(http.StatusCreated, tag)
 	})
 
-	// DELETE /api/recipes/:id - Delete recipe
-	r.DELETE("/api/recipes/:id", func(c *gin.Context) {
+	// GET /api/recipes/:id/parts - All the recipes extracted from the same video
+	r.GET("/api/recipes/:id/parts", func(c *gin.Context) {
 		id := c.Param("id")
 		var recipe models.Recipe
+		if err := database.DB.First(&recipe, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+			return
+		}
 
-		// Get recipe to delete files
+		respondCachedJSON(c, services.RecipeParts(&recipe))
+	})
+
+	// GET /api/recipes/:id/suggested-tags - Hashtags from the original post not yet used as tags
+	r.GET("/api/recipes/:id/suggested-tags", func(c *gin.Context) {
+		id := c.Param("id")
+		var recipe models.Recipe
+		if err := database.DB.Preload("Tags").First(&recipe, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"suggested_tags": services.SuggestedTags(&recipe)})
+	})
+
+	// GET /api/recipes/:id/nutrition - Nutrition per serving and per recipe with the ingredient matches
+	r.GET("/api/recipes/:id/nutrition", func(c *gin.Context) {
+		id := c.Param("id")
+		var recipe models.Recipe
+		if err := database.DB.Preload("Ingredients").First(&recipe, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+			return
+		}
+
+		// Read only: the stored values come from the pipeline or ComputePendingNutrition
+		breakdown := services.ComputeNutrition(&recipe)
+		c.JSON(http.StatusOK, nutritionResponse(&recipe, breakdown))
+	})
+
+	// PUT /api/recipes/:id/nutrition - Correct servings and ingredient matches manually
+	r.PUT("/api/recipes/:id/nutrition", func(c *gin.Context) {
+		id := c.Param("id")
+		var req UpdateNutritionRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var recipe models.Recipe
+		if err := database.DB.Preload("Ingredients").First(&recipe, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+			return
+		}
+
+		if req.Servings != nil {
+			if *req.Servings < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Servings can't be negative (0 if unknown)"})
+				return
+			}
+			recipe.Servings = *req.Servings
+		}
+
+		for _, m := range req.Ingredients {
+			var ing *models.Ingredient
+			for i := range recipe.Ingredients {
+				if recipe.Ingredients[i].ID == m.IngredientID {
+					ing = &recipe.Ingredients[i]
+				}
+			}
+			if ing == nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Ingredient does not belong to recipe", "ingredient_id": m.IngredientID})
+				return
+			}
+			if m.Food != "" && services.FindFood(m.Food) == nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown food", "food": m.Food})
+				return
+			}
+
+			if m.Reset {
+				ing.MatchManual = false
+				continue
+			}
+			ing.MatchManual = true
+			ing.FoodMatch = m.Food
+			if m.Grams != nil {
+				ing.Grams = m.Grams
+			} else if food := services.FindFood(m.Food); food != nil {
+				if g, ok := services.EstimateGrams(*ing, food); ok {
+					ing.Grams = &g
+				}
+			}
+		}
+
+		breakdown := services.ComputeNutrition(&recipe)
+		if err := services.SaveNutrition(&recipe); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save nutrition"})
+			return
+		}
+
+		c.JSON(http.StatusOK, nutritionResponse(&recipe, breakdown))
+	})
+
+	// GET /api/recipes/:id/substitutions - Alternatives per ingredient (local table first, AI second)
+	r.GET("/api/recipes/:id/substitutions", func(c *gin.Context) {
+		id := c.Param("id")
+		var recipe models.Recipe
+		if err := database.DB.Preload("Ingredients", services.OrderByID).First(&recipe, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+			return
+		}
+
+		var exclude []string
+		if param := c.Query("exclude_allergens"); param != "" {
+			for _, a := range strings.Split(param, ",") {
+				a = strings.ToLower(strings.TrimSpace(a))
+				if !services.IsAllergen(a) {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown allergen", "allergen": a, "allowed": services.AllergenNames})
+					return
+				}
+				exclude = append(exclude, a)
+			}
+		}
+		useAI := c.DefaultQuery("ai", "true") != "false"
+
+		suggestions, err := services.SuggestSubstitutions(&recipe, exclude, useAI)
+		response := gin.H{
+			"recipe_id":   recipe.ID,
+			"dietary":     recipe.Dietary,
+			"ingredients": suggestions,
+		}
+		if err != nil {
+			// Local suggestions are still useful when the AI fails (e.g. quota)
+			log.Printf("AI substitutions failed: %v", err)
+			response["ai_error"] = err.Error()
+		}
+		c.JSON(http.StatusOK, response)
+	})
+
+	// POST /api/recipes/:id/variants - Save a copy of the recipe with the chosen substitutions
+	r.POST("/api/recipes/:id/variants", func(c *gin.Context) {
+		id := c.Param("id")
+		var req CreateVariantRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var recipe models.Recipe
+		if err := database.DB.Preload("Ingredients", services.OrderByID).Preload("Steps", services.OrderByID).Preload("Tags").First(&recipe, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+			return
+		}
+
+		variant, err := services.CreateVariant(&recipe, req.Substitutions, req.Title)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusCreated, variant)
+	})
+
+	// GET /api/recipes/:id/variants - Variants created from a recipe
+	r.GET("/api/recipes/:id/variants", func(c *gin.Context) {
+		id := c.Param("id")
+		var variants []models.Recipe
+		if err := database.DB.Preload("Tags").Where("variant_of_id = ?", id).Order("created_at desc").Find(&variants).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		respondCachedJSON(c, variants)
+	})
+
+	// GET /api/recipes/:id/translations - Original language and cached translations
+	r.GET("/api/recipes/:id/translations", func(c *gin.Context) {
+		id := c.Param("id")
+		var recipe models.Recipe
+		if err := database.DB.Preload("Ingredients", services.OrderByID).Preload("Steps", services.OrderByID).First(&recipe, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+			return
+		}
+
+		respondCachedJSON(c, gin.H{
+			"original":  services.RecipeLanguage(&recipe),
+			"available": services.AvailableTranslations(&recipe),
+		})
+	})
+
+	// POST /api/recipes/:id/translations - Translate a recipe with the AI provider (cached)
+	r.POST("/api/recipes/:id/translations", func(c *gin.Context) {
+		id := c.Param("id")
+		var req TranslateRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		lang := strings.ToLower(strings.TrimSpace(req.Language))
+		if len(lang) != 2 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Language must be an ISO 639-1 code (e.g. es)"})
+			return
+		}
+
+		var recipe models.Recipe
+		if err := database.DB.Preload("Ingredients", services.OrderByID).Preload("Steps", services.OrderByID).First(&recipe, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+			return
+		}
+
+		if lang == services.RecipeLanguage(&recipe) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Recipe is already in that language"})
+			return
+		}
+
+		translation, err := services.TranslateRecipe(&recipe, lang, req.Refresh)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to translate recipe", "details": err.Error()})
+			return
+		}
+
+		services.ApplyTranslation(&recipe, translation)
+		c.Header("Content-Language", lang)
+		c.JSON(http.StatusOK, recipe)
+	})
+
+	// GET /api/recipes/:id/dietary - Allergens and diets with the ingredients that triggered them
+	r.GET("/api/recipes/:id/dietary", func(c *gin.Context) {
+		id := c.Param("id")
+		var recipe models.Recipe
+		if err := database.DB.Preload("Ingredients").First(&recipe, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+			return
+		}
+
+		computed, triggers := services.ClassifyDiet(recipe.Ingredients)
+		c.JSON(http.StatusOK, gin.H{
+			"dietary":  recipe.Dietary,
+			"computed": computed,
+			"triggers": triggers,
+		})
+	})
+
+	// PUT /api/recipes/:id/dietary - Override the computed allergens and diets
+	r.PUT("/api/recipes/:id/dietary", func(c *gin.Context) {
+		id := c.Param("id")
+		var req DietaryOverrideRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		allergens, ok := services.NormalizeAllergens(req.Allergens)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown allergen", "allowed": services.AllergenNames})
+			return
+		}
+		if req.Vegan && !req.Vegetarian {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A vegan recipe is also vegetarian"})
+			return
+		}
+
+		var recipe models.Recipe
 		if err := database.DB.First(&recipe, id).Error; err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
 			return
 		}
 
-		// Delete files
-		if recipe.LocalVideoPath != "" {
-			// LocalVideoPath is like "videos/file.mp4", we need full path "data/videos/file.mp4"
-			// But wait, in main.go we serve static from ./data/videos.
-			// If stored path is relative to web root, we need to adjust.
-			// Stored: "videos/vid.mp4". Static root: "./data/videos".
-			// Real path: "./data/" + "videos/vid.mp4" ? No.
-			// In processor.go: LocalVideoPath = "videos/" + basename.
-			// So real path is ./data/ + basename.
-
-			// Let's reconstruct safely
-			basename := filepath.Base(recipe.LocalVideoPath)
-			fullVideoPath := filepath.Join(dataPath, basename)
-			os.Remove(fullVideoPath)
-
-			// Remove thumbnail too?
-			// Thumbnail path logic is similar.
-			if recipe.ThumbnailPath != "" {
-				thumbBasename := filepath.Base(recipe.ThumbnailPath)
-				fullThumbPath := filepath.Join(dataPath, thumbBasename)
-				os.Remove(fullThumbPath)
+		recipe.Dietary = models.DietaryInfo{
+			Allergens:  allergens,
+			Vegetarian: req.Vegetarian,
+			Vegan:      req.Vegan,
+			Override:   true,
+			Classified: true,
+		}
+		if err := services.SaveDietary(&recipe); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save dietary info"})
+			return
+		}
+
+		c.JSON(http.StatusOK, recipe.Dietary)
+	})
+
+	// DELETE /api/recipes/:id/dietary - Remove the override and go back to the computed values
+	r.DELETE("/api/recipes/:id/dietary", func(c *gin.Context) {
+		id := c.Param("id")
+		var recipe models.Recipe
+		if err := database.DB.Preload("Ingredients").First(&recipe, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+			return
+		}
+
+		recipe.Dietary.Override = false
+		services.ClassifyRecipe(&recipe)
+		if err := services.SaveDietary(&recipe); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save dietary info"})
+			return
+		}
+
+		c.JSON(http.StatusOK, recipe.Dietary)
+	})
+
+	// PUT /api/recipes/:id/status - Mark a recipe as cooked and/or archived
+	r.PUT("/api/recipes/:id/status", func(c *gin.Context) {
+		id := c.Param("id")
+		var req RecipeStatusRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var recipe models.Recipe
+		if err := database.DB.First(&recipe, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+			return
+		}
+
+		updates := map[string]interface{}{}
+		if req.Cooked != nil {
+			recipe.Cooked = *req.Cooked
+			updates["cooked"] = recipe.Cooked
+		}
+		if req.Archived != nil {
+			recipe.Archived = *req.Archived
+			updates["archived"] = recipe.Archived
+		}
+		if len(updates) > 0 {
+			updates["version"] = services.NextVersion()
+			if err := database.DB.Model(&recipe).Updates(updates).Error; err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update recipe"})
+				return
 			}
 		}
 
-		// Delete from DB (Cascades should be handled by GORM if configured, otherwise manual)
-		// Gorm supports soft delete by default for models with gorm.Model.
-		// To delete permanently: Unscoped().Delete
-		if err := database.DB.Unscoped().Select("Ingredients", "Steps", "Tags").Delete(&recipe).Error; err != nil {
+		c.JSON(http.StatusOK, gin.H{"cooked": recipe.Cooked, "archived": recipe.Archived})
+	})
+
+	// GET /api/recipes/:id/media - Files of a recipe and their size
+	r.GET("/api/recipes/:id/media", func(c *gin.Context) {
+		id := c.Param("id")
+		var recipe models.Recipe
+		if err := database.DB.Preload("Steps").First(&recipe, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+			return
+		}
+
+		usage, err := services.RecipeMediaUsageFor(&recipe)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, usage)
+	})
+
+	// POST /api/recipes/:id/thumbnails - Regenerate the resized thumbnails of a recipe
+	r.POST("/api/recipes/:id/thumbnails", func(c *gin.Context) {
+		id := c.Param("id")
+		var recipe models.Recipe
+		if err := database.DB.First(&recipe, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+			return
+		}
+		if recipe.ThumbnailPath == "" {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Recipe has no thumbnail"})
+			return
+		}
+
+		if err := services.RegenerateThumbnails(&recipe); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, recipe.Thumbnails)
+	})
+
+	// POST /api/thumbnails/regenerate - Regenerate missing (or, with all, every) thumbnails in the background
+	r.POST("/api/thumbnails/regenerate", func(c *gin.Context) {
+		var req RegenerateThumbnailsRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		go services.GeneratePendingThumbnails(req.All)
+		c.JSON(http.StatusAccepted, gin.H{"message": "Thumbnail regeneration started"})
+	})
+
+	// GET /api/nutrition/foods - Search the nutrient table (for manual matching)
+	r.GET("/api/nutrition/foods", func(c *gin.Context) {
+		c.JSON(http.StatusOK, services.SearchFoods(c.Query("search")))
+	})
+
+	// DELETE /api/recipes/:id - Delete recipe
+	r.DELETE("/api/recipes/:id", func(c *gin.Context) {
+		id := c.Param("id")
+		var recipe models.Recipe
+
+		// Get recipe to delete files
+		if err := database.DB.Preload("Steps").First(&recipe, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+			return
+		}
+
+		// Files (unless shared with a variant), rows and a tombstone for syncing clients
+		if err := services.DeleteRecipe(&recipe); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete recipe"})
 			return
 		}
@@ -199,6 +750,99 @@ func main() {
 		c.JSON(http.StatusOK, gin.H{"message": "Recipe deleted"})
 	})
 
+	// GET /api/stats/ai-usage - Token usage and estimated cost per day and model
+	r.GET("/api/stats/ai-usage", func(c *gin.Context) {
+		days, _ := strconv.Atoi(c.DefaultQuery("days", "30"))
+		if days < 1 {
+			days = 30
+		}
+
+		stats, err := services.AIUsageStats(days)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		totalCost := 0.0
+		totalTokens := 0
+		for _, s := range stats {
+			totalCost += s.EstimatedCost
+			totalTokens += s.TotalTokens
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"data": stats,
+			"meta": gin.H{
+				"days":               days,
+				"total_tokens":       totalTokens,
+				"estimated_cost_usd": totalCost,
+			},
+			"quota": services.QuotaStatus(stats),
+		})
+	})
+
+	// GET /api/media/check - Orphaned files, missing files and disk usage (nothing is changed)
+	r.GET("/api/media/check", func(c *gin.Context) {
+		report, err := services.CheckMedia(services.MediaActionReport)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	})
+
+	// POST /api/media/check - Same check, deleting or quarantining the orphans
+	r.POST("/api/media/check", func(c *gin.Context) {
+		var req MediaCheckRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		report, err := services.CheckMedia(req.Action)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	})
+
+	// GET /api/media/usage - Disk space per recipe, largest first
+	r.GET("/api/media/usage", func(c *gin.Context) {
+		report, err := services.MediaUsage()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	})
+
+	// GET /api/media/janitor - What the retention policy would remove now (dry run)
+	r.GET("/api/media/janitor", func(c *gin.Context) {
+		report, err := services.RunJanitor(services.RetentionPolicyFromEnv(), true)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	})
+
+	// POST /api/media/janitor - Apply the retention policy now
+	r.POST("/api/media/janitor", func(c *gin.Context) {
+		var req JanitorRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		report, err := services.RunJanitor(services.RetentionPolicyFromEnv(), req.DryRun)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	})
+
 	// GET /api/version - Version Check
 	r.GET("/api/version", func(c *gin.Context) {
 		backendVersion := "1.1.0"
@@ -221,6 +865,8 @@ func main() {
 		page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
 		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
 		search := c.Query("search")
+		excludeAllergens := c.Query("exclude_allergens")
+		diet := c.Query("diet")
 
 		if page < 1 {
 			page = 1
@@ -237,6 +883,31 @@ func main() {
 			query = query.Where("search_text LIKE ?", normalizedTerm)
 		}
 
+		if excludeAllergens != "" {
+			for _, a := range strings.Split(excludeAllergens, ",") {
+				a = strings.ToLower(strings.TrimSpace(a))
+				if a == "" {
+					continue
+				}
+				if !services.IsAllergen(a) {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown allergen", "allergen": a, "allowed": services.AllergenNames})
+					return
+				}
+				query = query.Where("(',' || dietary_allergens || ',') NOT LIKE ?", "%,"+a+",%")
+			}
+		}
+
+		switch diet {
+		case "":
+		case "vegetarian":
+			query = query.Where("dietary_vegetarian = ?", true)
+		case "vegan":
+			query = query.Where("dietary_vegan = ?", true)
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown diet, use vegetarian or vegan"})
+			return
+		}
+
 		var total int64
 		query.Count(&total)
 
@@ -254,7 +925,7 @@ func main() {
 
 		totalPages := int(math.Ceil(float64(total) / float64(limit)))
 
-		c.JSON(http.StatusOK, gin.H{
+		respondCachedJSON(c, gin.H{
 			"data": recipes,
 			"meta": gin.H{
 				"current_page": page,
@@ -269,15 +940,375 @@ func main() {
 	r.GET("/api/recipes/:id", func(c *gin.Context) {
 		id := c.Param("id")
 		var recipe models.Recipe
-		result := database.DB.Preload("Ingredients").Preload("Steps").Preload("Tags").First(&recipe, id)
+		result := database.DB.Preload("Ingredients", services.OrderByID).Preload("Steps", services.OrderByID).
+			Preload("Tags").Preload("AlternateSources").First(&recipe, id)
 
 		if result.Error != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
 			return
 		}
-		c.JSON(http.StatusOK, recipe)
+
+		// Serve a cached translation if the client prefers another language
+		if langs := utils.ParseAcceptLanguage(c.GetHeader("Accept-Language")); len(langs) > 0 {
+			if lang := services.LocalizeRecipe(&recipe, langs); lang != "" {
+				c.Header("Content-Language", lang)
+			}
+		}
+		c.Header("Last-Modified", recipe.UpdatedAt.UTC().Format(http.TimeFormat))
+
+		// schema.org Recipe for other tools, with ?format=jsonld or Accept: application/ld+json
+		c.Header("Vary", "Accept-Language, Accept")
+		switch format := c.Query("format"); {
+		case format == "jsonld" || (format == "" && strings.Contains(c.GetHeader("Accept"), services.JSONLDContentType)):
+			ld := services.RecipeJSONLD(&recipe, func(key string) string { return requestBaseURL(c) + "/" + key })
+			respondCached(c, services.JSONLDContentType+"; charset=utf-8", ld)
+		case format == "" || format == "json":
+			respondCachedJSON(c, recipe)
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported format, use json or jsonld"})
+		}
+	})
+
+	// GET /api/recipes/changes - Recipes created or modified after a time, for client sync.
+	// The time comes in ?since= (RFC 3339, with after_id from the previous page) or in If-Modified-Since.
+	// Further pages are requested with the "next" cursor as since/after_id.
+	r.GET("/api/recipes/changes", func(c *gin.Context) {
+		var cursor services.ChangesCursor
+		if since := c.Query("since"); since != "" {
+			t, err := time.Parse(time.RFC3339Nano, since)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid since, use RFC 3339 (2024-01-02T15:04:05Z)"})
+				return
+			}
+			afterID, _ := strconv.ParseUint(c.Query("after_id"), 10, 64)
+			cursor = services.ChangesCursor{Since: t, AfterID: uint(afterID)}
+		} else if header := c.GetHeader("If-Modified-Since"); header != "" {
+			t, err := http.ParseTime(header)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid If-Modified-Since header"})
+				return
+			}
+			// Nothing changed after the second of the date
+			if !services.RecipeChangedSince(t.Add(time.Second)) {
+				c.Header("Last-Modified", t.UTC().Format(http.TimeFormat))
+				c.Status(http.StatusNotModified)
+				return
+			}
+			// HTTP dates have no fractions, so the whole second is sent again:
+			// clients skip the recipes they already have (same id and version)
+			cursor.Since = t.Add(-time.Nanosecond)
+		}
+
+		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+		changes, err := services.RecipesChangedSince(cursor, limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if !changes.LastModified.IsZero() {
+			c.Header("Last-Modified", changes.LastModified.UTC().Format(http.TimeFormat))
+		}
+		c.JSON(http.StatusOK, changes)
+	})
+
+	// GET /api/sync - Offline sync: recipes created, updated and deleted since ?token= (empty for the first sync)
+	r.GET("/api/sync", func(c *gin.Context) {
+		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+		resp, err := services.SyncChanges(c.Query("token"), limit)
+		if errors.Is(err, services.ErrInvalidSyncToken) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+
+	// POST /api/sync - Upload the edits made offline; edits based on an old version come back as conflicts
+	r.POST("/api/sync", func(c *gin.Context) {
+		var req SyncRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"results": services.ApplySyncEdits(req.Changes)})
+	})
+
+	// GET /api/export - ZIP with every recipe and its files (?media=false for the recipes only)
+	r.GET("/api/export", func(c *gin.Context) {
+		withMedia := c.DefaultQuery("media", "true") != "false"
+		filename := fmt.Sprintf("xgastroteca-%s.zip", time.Now().Format("20060102-150405"))
+		c.Header("Content-Type", "application/zip")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		c.Status(http.StatusOK)
+
+		// Headers are already sent, a failure can only cut the archive
+		if err := services.ExportLibrary(c.Writer, withMedia); err != nil {
+			log.Printf("Export failed: %v", err)
+		}
 	})
 
+	// POST /api/import - Restore an archive made by /api/export, sent as multipart "file"
+	r.POST("/api/import", func(c *gin.Context) {
+		header, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing archive file", "details": err.Error()})
+			return
+		}
+		f, err := header.Open()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer f.Close()
+
+		report, err := services.ImportLibrary(f, header.Size)
+		if errors.Is(err, services.ErrInvalidArchive) || errors.Is(err, services.ErrUnsupportedArchive) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	})
+
+	srv := &http.Server{Addr: ":8080", Handler: r}
+	go func() {
+		<-ctx.Done()
+		log.Println("Shutting down server...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
 	log.Println("Server starting on :8080")
-	r.Run(":8080")
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Server failed: %v", err)
+	}
+}
+
+// nutritionResponse builds the nutrition payload of a recipe.
+func nutritionResponse(recipe *models.Recipe, breakdown []services.IngredientNutrition) gin.H {
+	n := recipe.Nutrition
+	servings := max(recipe.Servings, 1)
+	return gin.H{
+		"servings": recipe.Servings,
+		"per_serving": gin.H{
+			"calories": n.Calories,
+			"protein":  n.Protein,
+			"carbs":    n.Carbs,
+			"fat":      n.Fat,
+			"fiber":    n.Fiber,
+		},
+		"per_recipe": gin.H{
+			"calories": n.Calories * float64(servings),
+			"protein":  n.Protein * float64(servings),
+			"carbs":    n.Carbs * float64(servings),
+			"fat":      n.Fat * float64(servings),
+			"fiber":    n.Fiber * float64(servings),
+		},
+		"unmatched":   n.Unmatched,
+		"ingredients": breakdown,
+	}
+}
+
+// respondProcessResult writes the outcome of the analysis pipeline. Quota errors
+// queue the job for a later retry.
+func respondProcessResult(c *gin.Context, jobURL string, recipe *models.Recipe, err error) {
+	if err != nil {
+		var dlErr *services.DownloadError
+		isDownloadError := errors.As(err, &dlErr)
+
+		// Check for Quota Error / Rate Limit
+		if (isDownloadError && dlErr.Kind == services.DownloadRateLimited) || strings.Contains(err.Error(), "429") || strings.Contains(strings.ToLower(err.Error()), "quota") {
+			// Queue the job
+			job := models.ProcessingJob{
+				URL:         jobURL,
+				Status:      models.JobStatusPending,
+				NextRetryAt: time.Now().Add(15 * time.Minute),
+				ErrorMsg:    "Initial Quota Exceeded",
+			}
+			database.DB.Create(&job)
+
+			c.JSON(http.StatusAccepted, gin.H{
+				"message":  "Quota exceeded. Added to processing queue.",
+				"queue_id": job.ID,
+				"status":   "queued",
+			})
+			return
+		}
+
+		// Check for "Not a Recipe"
+		if err.Error() == "not_a_recipe" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Video is not a food recipe", "code": "NOT_A_RECIPE"})
+			return
+		}
+
+		// Download failures, with the reason so the user can act (e.g. add cookies)
+		if isDownloadError {
+			status := http.StatusBadGateway
+			switch dlErr.Kind {
+			case services.DownloadLoginRequired, services.DownloadPrivate, services.DownloadAgeRestricted, services.DownloadGeoBlocked:
+				status = http.StatusForbidden
+			case services.DownloadNotFound, services.DownloadUnavailable:
+				status = http.StatusNotFound
+			case services.DownloadTooLarge:
+				status = http.StatusRequestEntityTooLarge
+			case services.DownloadTimeout:
+				status = http.StatusGatewayTimeout
+			}
+			c.JSON(status, gin.H{"error": "Failed to download video", "code": "DOWNLOAD_" + strings.ToUpper(dlErr.Kind), "details": dlErr.Message})
+			return
+		}
+
+		// General Error
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process video", "details": err.Error()})
+		return
+	}
+
+	response := ProcessResponse{Recipe: recipe}
+	if recipe.ExternalID != "" {
+		var parts []models.Recipe
+		database.DB.Preload("Ingredients", services.OrderByID).Preload("Steps", services.OrderByID).Preload("Tags").
+			Where("source = ? AND external_id = ?", recipe.Source, recipe.ExternalID).Order("part").Find(&parts)
+		if len(parts) > 1 {
+			response.Parts = parts
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// respondUploadError maps upload errors to HTTP status codes.
+func respondUploadError(c *gin.Context, err error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, services.ErrUploadTooLarge), errors.As(err, &maxBytesErr):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": services.ErrUploadTooLarge.Error(), "max_bytes": services.UploadMaxBytes()})
+	case errors.Is(err, services.ErrUploadType):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrUploadOffset):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrUploadIncomplete):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrUploadSessionClosed):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store upload", "details": err.Error()})
+	}
+}
+
+// serveMedia sends a stored file. Media keys are never rewritten (they carry
+// a timestamp or a content hash), so they are cached as immutable. Local files
+// support range requests for video seeking; remote stores answer with a
+// redirect to a signed URL (the bucket handles ranges), except HLS playlists,
+// which are proxied so their relative segment URLs keep going through here.
+func serveMedia(c *gin.Context) {
+	key, err := storage.CleanKey("videos" + c.Param("filepath"))
+	if err != nil || !strings.HasPrefix(key, "videos/") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Media not found"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	if p, ok := storage.LocalPath(storage.Media, key); ok {
+		info, err := os.Stat(p)
+		if err != nil || info.IsDir() {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Media not found"})
+			return
+		}
+		// http.ServeContent handles Range, If-Range and If-None-Match with this ETag
+		c.Header("ETag", fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+		c.Header("Cache-Control", immutableCache)
+		c.File(p)
+		return
+	}
+
+	if strings.HasSuffix(key, ".m3u8") {
+		info, err := storage.Media.Stat(ctx, key)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Media not found"})
+			return
+		}
+		body, err := storage.Media.Get(ctx, key)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Media not found"})
+			return
+		}
+		defer body.Close()
+		c.Header("Cache-Control", immutableCache)
+		c.DataFromReader(http.StatusOK, info.Size, storage.ContentType(key), body, nil)
+		return
+	}
+
+	url, err := storage.Media.SignedURL(ctx, key, storage.SignedURLExpiry)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign media URL"})
+		return
+	}
+	// The redirect is only valid while the signature is
+	c.Header("Cache-Control", fmt.Sprintf("private, max-age=%d", int((storage.SignedURLExpiry-5*time.Minute).Seconds())))
+	c.Redirect(http.StatusFound, url)
+}
+
+// Cache-Control of media files, which never change under the same key
+const immutableCache = "public, max-age=31536000, immutable"
+
+// respondCachedJSON sends a JSON body with an ETag (hash of the content) and
+// answers 304 Not Modified when the client already has it (If-None-Match).
+func respondCachedJSON(c *gin.Context, obj interface{}) {
+	respondCached(c, "application/json; charset=utf-8", obj)
+}
+
+// respondCached is respondCachedJSON with another JSON based content type.
+func respondCached(c *gin.Context, contentType string, obj interface{}) {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode response"})
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	c.Header("ETag", etag)
+	// Cached by the client, but always revalidated
+	c.Header("Cache-Control", "no-cache")
+
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, contentType, body)
+}
+
+// requestBaseURL is the scheme and host the client used to reach the server,
+// to build absolute URLs (behind a proxy, from the X-Forwarded-* headers).
+func requestBaseURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+	}
+	host := c.Request.Host
+	if fwd := c.GetHeader("X-Forwarded-Host"); fwd != "" {
+		host = strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+	return scheme + "://" + host
+}
+
+// etagMatches checks an If-None-Match header (a list of tags, weak or not, or "*").
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,22 @@
+package models
+
+import "gorm.io/gorm"
+
+// AIResponseCache keeps the raw AI answer for a video content, so reposts
+// of the same video don't pay for a new analysis (even if the recipe was deleted).
+type AIResponseCache struct {
+	gorm.Model
+	ContentHash    string `gorm:"index"`
+	PerceptualHash string
+	AIModel        string
+	Response       string
+}
+
+// SubstitutionCache keeps the substitutes suggested by the AI for an ingredient name.
+type SubstitutionCache struct {
+	gorm.Model
+	Ingredient string `gorm:"index"` // Normalized ingredient name
+	Substitute string
+	Ratio      string
+	Notes      string
+}
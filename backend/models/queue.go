@@ -17,9 +17,10 @@ const (
 
 type ProcessingJob struct {
 	gorm.Model
-	URL         string    `json:"url"`
-	Status      JobStatus `json:"status" gorm:"default:'PENDING'"`
-	RetryCount  int       `json:"retry_count" gorm:"default:0"`
-	NextRetryAt time.Time `json:"next_retry_at"`
-	ErrorMsg    string    `json:"error_msg"`
+	URL         string     `json:"url"`
+	Status      JobStatus  `json:"status" gorm:"default:'PENDING'"`
+	RetryCount  int        `json:"retry_count" gorm:"default:0"`
+	NextRetryAt time.Time  `json:"next_retry_at"`
+	ErrorMsg    string     `json:"error_msg"`
+	AIUsage     TokenUsage `json:"ai_usage" gorm:"embedded;embeddedPrefix:ai_"`
 }
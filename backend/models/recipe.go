@@ -1,6 +1,8 @@
 package models
 
 import (
+	"encoding/json"
+	"time"
 	"xgastroteca/utils"
 
 	"gorm.io/gorm"
@@ -13,36 +15,168 @@ type IngredientDTO struct {
 	Quantity string `json:"quantity"`
 }
 
+// StepDTO is a single step with the video moment where it is shown.
+type StepDTO struct {
+	Text         string   `json:"text"`
+	StartSeconds *float64 `json:"start_seconds,omitempty"`
+	EndSeconds   *float64 `json:"end_seconds,omitempty"`
+}
+
+// UnmarshalJSON also accepts a plain string, in case the model ignores
+// the requested object format and returns the steps as text.
+func (s *StepDTO) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		s.Text = text
+		return nil
+	}
+
+	type stepAlias StepDTO
+	var alias stepAlias
+	if err := json.Unmarshal(data, &alias); err != nil {
+		return err
+	}
+	*s = StepDTO(alias)
+	return nil
+}
+
 // AIRecipeDTO maps perfectly to the Gemini JSON response
 type AIRecipeDTO struct {
 	Title       string          `json:"title"`
 	Description string          `json:"description"`
 	Ingredients []IngredientDTO `json:"ingredients"`
-	Steps       []string        `json:"steps"`
+	Steps       []StepDTO       `json:"steps"`
 	Tags        []string        `json:"tags"`
 	CookingTime string          `json:"cooking_time"`
+	Servings    int             `json:"servings"`
+	Language    string          `json:"language"`
 	Error       string          `json:"error,omitempty"`
+
+	// Part of the video showing this recipe, when it has several
+	StartSeconds *float64 `json:"start_seconds"`
+	EndSeconds   *float64 `json:"end_seconds"`
+}
+
+// AIRecipesDTO is the AI answer for videos that may contain several recipes.
+type AIRecipesDTO struct {
+	Recipes []AIRecipeDTO `json:"recipes"`
+	Error   string        `json:"error,omitempty"`
 }
 
 // --- GORM Database Models ---
 
+// Sources of recipes that don't come from a video platform
+const (
+	SourceUpload = "upload" // File uploaded by the user
+	SourceWeb    = "web"    // Regular web page (recipe blogs)
+)
+
+// SourceMetadata is the post information reported by yt-dlp (--write-info-json).
+type SourceMetadata struct {
+	Caption     string  // Post description/caption written by the creator
+	Uploader    string  // Creator name or handle
+	UploadDate  string  // YYYYMMDD as reported by yt-dlp
+	Duration    float64 // Seconds
+	OriginalURL string  // Canonical post URL
+	Hashtags    string  // Comma separated, without '#'
+}
+
+// NutritionInfo is the estimated nutrition of a recipe, per serving.
+type NutritionInfo struct {
+	Calories  float64 // kcal
+	Protein   float64 // g
+	Carbs     float64 // g
+	Fat       float64 // g
+	Fiber     float64 // g
+	Unmatched int     // Ingredients left out of the estimation
+	Computed  bool
+}
+
+// DietaryInfo holds the allergens and diets of a recipe.
+type DietaryInfo struct {
+	Allergens  string // Comma separated: gluten,lactose,nuts,egg,shellfish,fish
+	Vegetarian bool
+	Vegan      bool
+	Override   bool // Set by the user, never overwritten by the classifier
+	Classified bool
+}
+
+// ThumbnailVariant is a resized copy of the thumbnail.
+type ThumbnailVariant struct {
+	JPEG   string `json:"jpeg" gorm:"column:jpeg"`
+	WebP   string `json:"webp" gorm:"column:webp"` // Empty when no WebP encoder is available
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// ThumbnailSet holds the thumbnail sizes used by the app (see services.GenerateThumbnails).
+type ThumbnailSet struct {
+	Card     ThumbnailVariant `json:"card" gorm:"embedded;embeddedPrefix:card_"`     // List cards
+	Header   ThumbnailVariant `json:"header" gorm:"embedded;embeddedPrefix:header_"` // Detail header
+	BlurHash string           `json:"blurhash"`                                      // Placeholder shown while the image loads
+	Source   string           `json:"-"`                                             // ThumbnailPath they were generated from
+}
+
 type Recipe struct {
 	gorm.Model
-	LocalVideoPath string
-	ThumbnailPath  string // Path to local thumbnail file (e.g. videos/video_123.jpg)
-	Title          string
-	Description    string
-	CookingTime    string
-	VideoFileID    string // Internal or Gemini file ID if needed
+	LocalVideoPath    string
+	OriginalVideoPath string       // Downloaded file kept next to a transcoded LocalVideoPath (TRANSCODE_KEEP_ORIGINAL)
+	StreamPath        string       // HLS playlist (e.g. videos/video_123_hls/index.m3u8), empty if disabled
+	ThumbnailPath     string       // Path to local thumbnail file (e.g. videos/video_123.jpg)
+	Thumbnails        ThumbnailSet `json:"thumbnails" gorm:"embedded;embeddedPrefix:thumbnails_"`
+	Title             string
+	Description       string
+	CookingTime       string
+	Servings          int    // 0 if unknown
+	Language          string // ISO 639-1 code of the original recipe text
+	VideoFileID       string // Internal or Gemini file ID if needed
+	Transcript        string // Speech-to-text of the video audio (whisper)
+	VariantOfID       *uint  // Original recipe when this is a variant with substitutions
+
+	// Original post metadata (caption, creator...)
+	SourceMeta SourceMetadata `gorm:"embedded;embeddedPrefix:source_"`
 
-	// Composite Unique Index for Multi-Platform Support
-	Source     string `gorm:"uniqueIndex:idx_source_id"` // instagram, youtube, tiktok
-	ExternalID string `gorm:"uniqueIndex:idx_source_id"`
+	// Estimated nutrition (see services.ComputeNutrition)
+	Nutrition NutritionInfo `gorm:"embedded;embeddedPrefix:nutrition_"`
+
+	// Allergens and diets (see services.ClassifyRecipe)
+	Dietary DietaryInfo `gorm:"embedded;embeddedPrefix:dietary_"`
+
+	// Tokens consumed by the AI extraction
+	AIUsage TokenUsage `gorm:"embedded;embeddedPrefix:ai_"`
+
+	// Composite Unique Index for Multi-Platform Support.
+	// Videos with several recipes save one recipe per Part (0, 1, 2...).
+	Source     string `gorm:"uniqueIndex:idx_source_part"` // instagram, youtube, tiktok
+	ExternalID string `gorm:"uniqueIndex:idx_source_part"`
+	Part       int    `gorm:"uniqueIndex:idx_source_part"`
+
+	// Incremented on every change, offline edits based on an older version are conflicts
+	Version int `gorm:"default:1"`
+
+	// Set by the user; cooked and archived recipes may lose their video (MEDIA_DROP_ARCHIVED_VIDEOS)
+	Cooked   bool
+	Archived bool
+
+	// Video removed by the retention policies, only the images are left
+	VideoRemovedAt *time.Time
+
+	// Time range of the video showing this recipe (nil when it is the whole video)
+	StartSeconds *float64
+	EndSeconds   *float64
+
+	// Standard URL of the post, without tracking parameters (see utils.CanonicalizeURL)
+	CanonicalURL string `gorm:"index"`
+
+	// Hashes of the downloaded video to detect reposts under other URLs
+	ContentHash    string `gorm:"index"` // SHA-256 of the file
+	PerceptualHash string // dHash of a few keyframes (see services.PerceptualHash)
 
 	// Relations
-	Ingredients []Ingredient `gorm:"foreignKey:RecipeID"`
-	Steps       []Step       `gorm:"foreignKey:RecipeID"`
-	Tags        []Tag        `gorm:"foreignKey:RecipeID"`
+	Ingredients      []Ingredient   `gorm:"foreignKey:RecipeID"`
+	Steps            []Step         `gorm:"foreignKey:RecipeID"`
+	Tags             []Tag          `gorm:"foreignKey:RecipeID"`
+	AlternateSources []RecipeSource `gorm:"foreignKey:RecipeID"`
 
 	// Search Optimization
 	SearchText string `json:"-" gorm:"index"`
@@ -50,21 +184,34 @@ type Recipe struct {
 
 // BeforeSave hook to populate SearchText
 func (r *Recipe) BeforeSave(tx *gorm.DB) (err error) {
-	r.SearchText = utils.NormalizeString(r.Title + " " + r.Description)
+	r.UpdateSearchText()
 	return
 }
 
+// UpdateSearchText recomputes SearchText from the title, description and transcript.
+func (r *Recipe) UpdateSearchText() {
+	r.SearchText = utils.NormalizeString(r.Title + " " + r.Description + " " + r.Transcript)
+}
+
 type Ingredient struct {
 	gorm.Model
 	RecipeID uint
 	Item     string
 	Quantity string
+
+	// Nutrition table match
+	FoodMatch   string   // Key in the nutrient table ("" if not found)
+	Grams       *float64 // Estimated weight (nil if unknown)
+	MatchManual bool     // Set by the user, never overwritten by the automatic matching
 }
 
 type Step struct {
 	gorm.Model
-	RecipeID uint
-	Text     string
+	RecipeID     uint
+	Text         string
+	StartSeconds *float64 // Moment in the video where the step starts (nil if unknown)
+	EndSeconds   *float64
+	ImagePath    string // Still of the step (e.g. videos/video_123_step_01.jpg)
 }
 
 type Tag struct {
@@ -72,3 +219,28 @@ type Tag struct {
 	RecipeID uint
 	Name     string
 }
+
+// RecipeSource is another URL where the same video was published (repost).
+type RecipeSource struct {
+	gorm.Model
+	RecipeID   uint
+	Source     string `gorm:"uniqueIndex:idx_alt_source_id"`
+	ExternalID string `gorm:"uniqueIndex:idx_alt_source_id"`
+	URL        string
+}
+
+// RecipeTranslation is a cached localized version of a recipe.
+// Ingredients and steps are stored as JSON arrays in the same order as the original.
+type RecipeTranslation struct {
+	gorm.Model
+	RecipeID    uint   `gorm:"uniqueIndex:idx_recipe_lang"`
+	Language    string `gorm:"uniqueIndex:idx_recipe_lang"`
+	Title       string
+	Description string
+	CookingTime string
+	Ingredients string // JSON []IngredientDTO
+	Steps       string // JSON []string
+
+	// SHA-256 of the texts it was translated from, outdated when they change
+	SourceHash string
+}
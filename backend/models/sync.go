@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// RecipeTombstone remembers a hard deleted recipe, so syncing clients
+// remove their copy (see services.SyncChanges).
+type RecipeTombstone struct {
+	ID        uint      `json:"-" gorm:"primarykey"`
+	RecipeID  uint      `json:"id" gorm:"index"`
+	DeletedAt time.Time `json:"deleted_at" gorm:"index"`
+}
@@ -0,0 +1,14 @@
+package models
+
+import "gorm.io/gorm"
+
+// UploadSession tracks a resumable video upload sent in chunks.
+type UploadSession struct {
+	gorm.Model
+	UploadID string `json:"upload_id" gorm:"uniqueIndex"`
+	Filename string `json:"filename"`
+	MimeType string `json:"mime_type"`
+	Size     int64  `json:"size"`
+	Offset   int64  `json:"offset"` // Bytes received so far
+	TempPath string `json:"-"`
+}
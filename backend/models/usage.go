@@ -0,0 +1,20 @@
+package models
+
+import "gorm.io/gorm"
+
+// TokenUsage is the AI token consumption attached to a recipe or job.
+type TokenUsage struct {
+	Model          string
+	PromptTokens   int
+	ResponseTokens int
+}
+
+// AIUsageRecord stores every AI call (successful or not) for the usage statistics.
+type AIUsageRecord struct {
+	gorm.Model
+	Purpose        string `json:"purpose" gorm:"index"` // e.g. analyze_video
+	AIModel        string `json:"model" gorm:"index"`
+	PromptTokens   int    `json:"prompt_tokens"`
+	ResponseTokens int    `json:"response_tokens"`
+	TotalTokens    int    `json:"total_tokens"`
+}
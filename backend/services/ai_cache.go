@@ -0,0 +1,97 @@
+package services
+
+import (
+	"log"
+	"xgastroteca/database"
+	"xgastroteca/models"
+)
+
+// FindCachedAnalysis returns a previous AI response for the same video content, if any.
+func FindCachedAnalysis(contentHash, perceptualHash string) *models.AIResponseCache {
+	if contentHash != "" {
+		var cached models.AIResponseCache
+		if err := database.DB.Where("content_hash = ?", contentHash).Order("id desc").First(&cached).Error; err == nil {
+			return &cached
+		}
+	}
+
+	if perceptualHash == "" {
+		return nil
+	}
+
+	// Only the hashes, the responses are large
+	var candidates []models.AIResponseCache
+	database.DB.Select("id", "perceptual_hash").Where("perceptual_hash <> ''").Order("id desc").Find(&candidates)
+	for _, c := range candidates {
+		if PerceptualHashesMatch(perceptualHash, c.PerceptualHash) {
+			var cached models.AIResponseCache
+			if err := database.DB.First(&cached, c.ID).Error; err == nil {
+				return &cached
+			}
+		}
+	}
+	return nil
+}
+
+// StoreCachedAnalysis saves a raw AI response for later reuse.
+func StoreCachedAnalysis(contentHash, perceptualHash, aiModel, response string) {
+	if contentHash == "" && perceptualHash == "" {
+		return
+	}
+
+	entry := models.AIResponseCache{
+		ContentHash:    contentHash,
+		PerceptualHash: perceptualHash,
+		AIModel:        aiModel,
+		Response:       response,
+	}
+	if err := database.DB.Create(&entry).Error; err != nil {
+		log.Printf("Failed to cache AI response: %v", err)
+	}
+}
+
+// FindRecipeByMedia looks for a recipe whose video has the same content
+// (exact hash) or looks the same and lasts as long (perceptual hash).
+func FindRecipeByMedia(contentHash, perceptualHash string) *models.Recipe {
+	var recipe models.Recipe
+	if contentHash != "" {
+		if err := database.DB.Where("content_hash = ?", contentHash).First(&recipe).Error; err == nil {
+			return &recipe
+		}
+	}
+
+	if perceptualHash == "" {
+		return nil
+	}
+
+	var candidates []models.Recipe
+	database.DB.Select("id", "perceptual_hash").Where("perceptual_hash <> ''").Find(&candidates)
+	for _, c := range candidates {
+		if PerceptualHashesMatch(perceptualHash, c.PerceptualHash) {
+			if err := database.DB.First(&recipe, c.ID).Error; err == nil {
+				return &recipe
+			}
+		}
+	}
+	return nil
+}
+
+// LinkAlternateSource records that a recipe was also published at another URL.
+func LinkAlternateSource(recipe *models.Recipe, source, externalID, url string) {
+	if recipe.Source == source && recipe.ExternalID == externalID {
+		return
+	}
+
+	alt := models.RecipeSource{
+		RecipeID:   recipe.ID,
+		Source:     source,
+		ExternalID: externalID,
+		URL:        url,
+	}
+	if err := database.DB.Create(&alt).Error; err != nil {
+		log.Printf("Failed to link alternate source: %v", err)
+		return
+	}
+	TouchRecipe(recipe.ID)
+	log.Printf("Linked %s/%s as alternate source of recipe %d", source, externalID, recipe.ID)
+}
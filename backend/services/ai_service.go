@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 	"xgastroteca/models"
 
@@ -13,17 +14,102 @@ import (
 	"google.golang.org/api/option"
 )
 
-// AnalyzeVideo uploads a video to Gemini and extracts a recipe from it.
-func AnalyzeVideo(videoPath string) (*models.Recipe, error) {
+// AnalysisContext holds extra text gathered before the AI analysis
+// that helps Gemini understand the video.
+type AnalysisContext struct {
+	Transcript string
+	Metadata   *models.SourceMetadata
+
+	// Hashes of the downloaded file, used to reuse previous AI responses
+	ContentHash    string
+	PerceptualHash string
+}
+
+// AnalyzeVideo uploads a video to Gemini and extracts its recipes (usually one,
+// several for videos like "3 breakfasts in 5 minutes").
+// When a cached response exists for the same video content, Gemini is not called.
+func AnalyzeVideo(videoPath string, actx AnalysisContext) ([]*models.Recipe, error) {
+	var jsonText string
+	var usage models.TokenUsage
+	var fileID string
+
+	cached := FindCachedAnalysis(actx.ContentHash, actx.PerceptualHash)
+	if cached != nil {
+		log.Printf("Reusing cached AI response #%d for this video", cached.ID)
+		jsonText = cached.Response
+		usage = models.TokenUsage{Model: cached.AIModel}
+	} else {
+		var err error
+		jsonText, usage, fileID, err = generateFromVideo(videoPath, buildRecipePrompt(actx))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	recipes, err := recipesFromAIResponse(jsonText)
+	// Truncated or malformed answers are not cached, a retry asks again
+	if cached == nil && isFinalAIAnswer(err) {
+		StoreCachedAnalysis(actx.ContentHash, actx.PerceptualHash, usage.Model, jsonText)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, recipe := range recipes {
+		recipe.LocalVideoPath = videoPath
+		recipe.VideoFileID = fileID
+		recipe.Transcript = actx.Transcript
+		recipe.ContentHash = actx.ContentHash
+		recipe.PerceptualHash = actx.PerceptualHash
+	}
+	// The tokens were spent once for the whole video
+	recipes[0].AIUsage = usage
+	return recipes, nil
+}
+
+// isFinalAIAnswer reports whether a parsed AI answer is worth caching: the
+// recipes, or the verdict that the content is not a recipe.
+func isFinalAIAnswer(parseErr error) bool {
+	return parseErr == nil || parseErr.Error() == "not_a_recipe"
+}
+
+// buildRecipePrompt creates the extraction prompt with the available context.
+func buildRecipePrompt(actx AnalysisContext) string {
+	prompt := "Eres un chef experto. Analiza el video y extrae las recetas en formato JSON con la forma {\"recipes\": [...]}. Normalmente el video muestra una sola receta; si muestra varias recetas distintas (ej: \"3 desayunos en 5 minutos\"), devuelve un objeto por receta sin mezclarlas. Cada receta incluye: title, description, ingredients (lista de objetos con campos 'item' y 'quantity'), steps (lista de objetos con campos 'text', 'start_seconds' y 'end_seconds' indicando en qué segundo del video empieza y termina cada paso; omite los segundos si el paso no se muestra en el video), tags, cooking_time, servings (número entero de raciones, 0 si no se indica), language (código ISO 639-1 del idioma en que está el video, ej: es, en, it, pt), y start_seconds y end_seconds con el tramo del video que muestra esa receta. Escribe las recetas en el idioma original del video. IMPORTANTE: Si el video NO es claramente sobre preparación de alimentos o una receta (ej: es un baile, un vlog sin cocina, un meme), devuelve un JSON ÚNICAMENTE con el campo: {\"error\": \"not_a_recipe\"}. Responde SOLO con el JSON limpio, sin bloques de código markdown."
+
+	if m := actx.Metadata; m != nil {
+		if m.Caption != "" {
+			prompt += "\n\nTexto (caption) publicado junto al video. Suele contener la lista de ingredientes y cantidades exactas:\n" + m.Caption
+		}
+		if m.Uploader != "" {
+			prompt += "\n\nAutor del video: " + m.Uploader
+		}
+		if m.Hashtags != "" {
+			prompt += "\n\nHashtags del post (úsalos como pista para los tags): " + m.Hashtags
+		}
+	}
+
+	if actx.Transcript != "" {
+		prompt += "\n\nTranscripción del audio del video (puede contener errores):\n" + actx.Transcript
+	}
+
+	return prompt
+}
+
+// generateFromVideo uploads the video to Gemini and returns the raw JSON answer to the prompt,
+// the token usage and the Gemini file name.
+func generateFromVideo(videoPath string, prompt string) (string, models.TokenUsage, string, error) {
+	var usage models.TokenUsage
+
 	ctx := context.Background()
 	apiKey := os.Getenv("GEMINI_API_KEY")
 	if apiKey == "" {
-		return nil, fmt.Errorf("GEMINI_API_KEY environment variable not set")
+		return "", usage, "", fmt.Errorf("GEMINI_API_KEY environment variable not set")
 	}
 
 	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create Gemini client: %v", err)
+		return "", usage, "", fmt.Errorf("failed to create Gemini client: %v", err)
 	}
 	defer client.Close()
 
@@ -31,13 +117,13 @@ func AnalyzeVideo(videoPath string) (*models.Recipe, error) {
 	log.Printf("Uploading file: %s", videoPath)
 	f, err := os.Open(videoPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open video file: %v", err)
+		return "", usage, "", fmt.Errorf("failed to open video file: %v", err)
 	}
 	defer f.Close()
 
 	uploadResult, err := client.UploadFile(ctx, "", f, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to upload file: %v", err)
+		return "", usage, "", fmt.Errorf("failed to upload file: %v", err)
 	}
 	log.Printf("File uploaded. URI: %s", uploadResult.URI)
 
@@ -53,7 +139,7 @@ func AnalyzeVideo(videoPath string) (*models.Recipe, error) {
 	for {
 		file, err := client.GetFile(ctx, uploadResult.Name)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get file state: %v", err)
+			return "", usage, "", fmt.Errorf("failed to get file state: %v", err)
 		}
 
 		log.Printf("File processing state: %s", file.State)
@@ -62,32 +148,31 @@ func AnalyzeVideo(videoPath string) (*models.Recipe, error) {
 			break
 		}
 		if file.State == genai.FileStateFailed {
-			return nil, fmt.Errorf("file processing failed")
+			return "", usage, "", fmt.Errorf("file processing failed")
 		}
 
 		time.Sleep(5 * time.Second)
 	}
 
 	// 3. Generate content
-	model := client.GenerativeModel("gemini-2.5-flash")
+	modelName := GeminiModelName()
+	model := client.GenerativeModel(modelName)
 	model.ResponseMIMEType = "application/json" // Force JSON response
 
-	prompt := "Eres un chef experto. Analiza el video y extrae la receta en formato JSON. Incluye: title, description, ingredients (lista de objetos con campos 'item' y 'quantity'), steps, tags y cooking_time. IMPORTANTE: Si el video NO es claramente sobre preparación de alimentos o una receta (ej: es un baile, un vlog sin cocina, un meme), devuelve un JSON ÚNICAMENTE con el campo: {\"error\": \"not_a_recipe\"}. Responde SOLO con el JSON limpio, sin bloques de código markdown."
-
 	// Pass the file URI directly if the client supports it via Part mechanism
 	// or retrieve the file object again if needed, but GenAI-Go usually takes the URIPart or FileData
 	// The standard way in the official library for a File uploaded via File API is to use FileData with the file URI.
 
 	resp, err := model.GenerateContent(ctx, genai.Text(prompt), genai.FileData{URI: uploadResult.URI})
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate content: %v", err)
+		return "", usage, "", fmt.Errorf("failed to generate content: %v", err)
 	}
+	usage = recordAIUsage("analyze_video", modelName, resp)
 
 	if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
-		return nil, fmt.Errorf("no content generated")
+		return "", usage, "", fmt.Errorf("no content generated")
 	}
 
-	// 4. Parse response into DTO
 	var jsonText string
 	for _, part := range resp.Candidates[0].Content.Parts {
 		if txt, ok := part.(genai.Text); ok {
@@ -96,24 +181,74 @@ func AnalyzeVideo(videoPath string) (*models.Recipe, error) {
 	}
 
 	log.Printf("Gemini Response: %s", jsonText)
+	return jsonText, usage, uploadResult.Name, nil
+}
+
+// recipesFromAIResponse parses the Gemini JSON answer into one recipe per
+// recipe shown in the video. Single recipe answers (cached before videos with
+// several recipes were supported) are accepted too.
+func recipesFromAIResponse(jsonText string) ([]*models.Recipe, error) {
+	// 4. Parse response into DTOs
+	var dtos []models.AIRecipeDTO
+	if strings.HasPrefix(strings.TrimSpace(jsonText), "[") {
+		if err := json.Unmarshal([]byte(jsonText), &dtos); err != nil {
+			return nil, fmt.Errorf("failed to parse JSON response: %v \nRaw text: %s", err, jsonText)
+		}
+	} else {
+		var multi models.AIRecipesDTO
+		if err := json.Unmarshal([]byte(jsonText), &multi); err != nil {
+			return nil, fmt.Errorf("failed to parse JSON response: %v \nRaw text: %s", err, jsonText)
+		}
+		if multi.Error == "not_a_recipe" {
+			return nil, fmt.Errorf("not_a_recipe")
+		}
+		dtos = multi.Recipes
+
+		if len(dtos) == 0 {
+			var single models.AIRecipeDTO
+			if err := json.Unmarshal([]byte(jsonText), &single); err != nil {
+				return nil, fmt.Errorf("failed to parse JSON response: %v \nRaw text: %s", err, jsonText)
+			}
+			dtos = append(dtos, single)
+		}
+	}
 
-	var dto models.AIRecipeDTO
-	if err := json.Unmarshal([]byte(jsonText), &dto); err != nil {
-		return nil, fmt.Errorf("failed to parse JSON response: %v \nRaw text: %s", err, jsonText)
+	// 5. Convert DTOs to GORM Models
+	var recipes []*models.Recipe
+	for _, dto := range dtos {
+		if dto.Error == "not_a_recipe" || (dto.Title == "" && len(dto.Ingredients) == 0) {
+			continue
+		}
+		recipe := recipeFromDTO(dto)
+		recipe.Part = len(recipes)
+		recipes = append(recipes, recipe)
 	}
 
-	if dto.Error == "not_a_recipe" {
+	if len(recipes) == 0 {
 		return nil, fmt.Errorf("not_a_recipe")
 	}
+	return recipes, nil
+}
+
+// recipeFromAIResponse parses a Gemini JSON answer expected to hold a single recipe.
+func recipeFromAIResponse(jsonText string) (*models.Recipe, error) {
+	recipes, err := recipesFromAIResponse(jsonText)
+	if err != nil {
+		return nil, err
+	}
+	return recipes[0], nil
+}
 
-	// 5. Convert DTO to GORM Model
+// recipeFromDTO converts one recipe of the AI answer into a model.
+func recipeFromDTO(dto models.AIRecipeDTO) *models.Recipe {
 	recipe := &models.Recipe{
-		Title:          dto.Title,
-		Description:    dto.Description,
-		CookingTime:    dto.CookingTime,
-		LocalVideoPath: videoPath,
-		VideoFileID:    uploadResult.Name,
+		Title:       dto.Title,
+		Description: dto.Description,
+		CookingTime: dto.CookingTime,
+		Servings:    dto.Servings,
+		Language:    languageCode(dto.Language),
 	}
+	recipe.StartSeconds, recipe.EndSeconds = validTimeRange(dto.StartSeconds, dto.EndSeconds)
 
 	// Map Ingredients
 	for _, ing := range dto.Ingredients {
@@ -124,9 +259,12 @@ func AnalyzeVideo(videoPath string) (*models.Recipe, error) {
 	}
 
 	// Map Steps
-	for _, stepText := range dto.Steps {
+	for _, step := range dto.Steps {
+		start, end := validTimeRange(step.StartSeconds, step.EndSeconds)
 		recipe.Steps = append(recipe.Steps, models.Step{
-			Text: stepText,
+			Text:         step.Text,
+			StartSeconds: start,
+			EndSeconds:   end,
 		})
 	}
 
@@ -137,5 +275,53 @@ func AnalyzeVideo(videoPath string) (*models.Recipe, error) {
 		})
 	}
 
-	return recipe, nil
+	return recipe
+}
+
+// validTimeRange discards nonsensical ranges instead of pointing the player to a wrong moment.
+func validTimeRange(start, end *float64) (*float64, *float64) {
+	if start != nil && (*start < 0 || (end != nil && *end < *start)) {
+		return nil, nil
+	}
+	return start, end
+}
+
+// generateText sends a text-only prompt to Gemini and returns the JSON answer.
+// purpose is used for the usage statistics.
+func generateText(purpose string, prompt string) (string, models.TokenUsage, error) {
+	var usage models.TokenUsage
+
+	ctx := context.Background()
+	apiKey := os.Getenv("GEMINI_API_KEY")
+	if apiKey == "" {
+		return "", usage, fmt.Errorf("GEMINI_API_KEY environment variable not set")
+	}
+
+	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
+	if err != nil {
+		return "", usage, fmt.Errorf("failed to create Gemini client: %v", err)
+	}
+	defer client.Close()
+
+	modelName := GeminiModelName()
+	model := client.GenerativeModel(modelName)
+	model.ResponseMIMEType = "application/json" // Force JSON response
+
+	resp, err := model.GenerateContent(ctx, genai.Text(prompt))
+	if err != nil {
+		return "", usage, fmt.Errorf("failed to generate content: %v", err)
+	}
+	usage = recordAIUsage(purpose, modelName, resp)
+
+	if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
+		return "", usage, fmt.Errorf("no content generated")
+	}
+
+	var jsonText string
+	for _, part := range resp.Candidates[0].Content.Parts {
+		if txt, ok := part.(genai.Text); ok {
+			jsonText += string(txt)
+		}
+	}
+	return jsonText, usage, nil
 }
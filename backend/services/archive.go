@@ -0,0 +1,439 @@
+package services
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"xgastroteca/database"
+	"xgastroteca/models"
+	"xgastroteca/storage"
+
+	"gorm.io/gorm"
+)
+
+// Library archive layout:
+//
+//	manifest.json        ArchiveManifest
+//	recipes/<id>.json    ArchiveRecipe, one per recipe
+//	media/<key>          Videos, thumbnails, step images and HLS files, by store key
+const (
+	archiveFormat  = "xgastroteca-library"
+	archiveVersion = 1
+)
+
+var (
+	ErrInvalidArchive     = errors.New("not a recipe library archive")
+	ErrUnsupportedArchive = errors.New("archive made by a newer version")
+)
+
+// ArchiveManifest describes a library archive.
+type ArchiveManifest struct {
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+	Recipes    int       `json:"recipes"`
+	Media      bool      `json:"media"` // False when exported without the media files
+}
+
+// ArchiveRecipe is a recipe with everything that belongs to it.
+type ArchiveRecipe struct {
+	Recipe       models.Recipe              `json:"recipe"`
+	Translations []models.RecipeTranslation `json:"translations"`
+}
+
+// ImportReport is the result of importing an archive.
+type ImportReport struct {
+	Imported   int           `json:"imported"`
+	Skipped    int           `json:"skipped"` // Already in the library (same Source, ExternalID and Part)
+	MediaFiles int           `json:"media_files"`
+	IDs        map[uint]uint `json:"ids"` // Recipe ID in the archive -> ID in this library
+	Errors     []string      `json:"errors,omitempty"`
+}
+
+// ExportLibrary writes every recipe and, when withMedia is set, its files
+// as a ZIP archive. It streams: nothing is kept in memory or on disk.
+func ExportLibrary(w io.Writer, withMedia bool) error {
+	ctx := context.Background()
+	zw := zip.NewWriter(w)
+
+	var ids []uint
+	if err := database.DB.Model(&models.Recipe{}).Order("id").Pluck("id", &ids).Error; err != nil {
+		return fmt.Errorf("failed to list recipes: %v", err)
+	}
+
+	manifest := ArchiveManifest{Format: archiveFormat, Version: archiveVersion, ExportedAt: time.Now(), Recipes: len(ids), Media: withMedia}
+	if err := writeArchiveJSON(zw, "manifest.json", manifest); err != nil {
+		return err
+	}
+
+	written := make(map[string]bool)
+	for _, id := range ids {
+		var entry ArchiveRecipe
+		err := database.DB.Preload("Ingredients", OrderByID).Preload("Steps", OrderByID).
+			Preload("Tags", OrderByID).Preload("AlternateSources", OrderByID).
+			First(&entry.Recipe, id).Error
+		if err != nil {
+			// Deleted while exporting
+			continue
+		}
+		database.DB.Where("recipe_id = ?", id).Order("id").Find(&entry.Translations)
+
+		if err := writeArchiveJSON(zw, fmt.Sprintf("recipes/%d.json", id), entry); err != nil {
+			return err
+		}
+		if !withMedia {
+			continue
+		}
+
+		for _, key := range archiveMediaKeys(ctx, &entry.Recipe) {
+			// Variants and parts share their files
+			if written[key] {
+				continue
+			}
+			written[key] = true
+			if err := writeArchiveMedia(ctx, zw, key); errors.Is(err, storage.ErrNotFound) {
+				log.Printf("Export: %s of recipe %d is missing", key, id)
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+
+	return zw.Close()
+}
+
+// archiveMediaKeys lists the stored files of a recipe, HLS segments included.
+func archiveMediaKeys(ctx context.Context, recipe *models.Recipe) []string {
+	keys := recipeMediaKeys(recipe)
+	if recipe.StreamPath != "" {
+		objects, err := storage.Media.List(ctx, path.Dir(recipe.StreamPath)+"/")
+		if err != nil {
+			log.Printf("Export: failed to list HLS files of recipe %d: %v", recipe.ID, err)
+		}
+		for _, obj := range objects {
+			keys = append(keys, obj.Key)
+		}
+	}
+	return keys
+}
+
+func writeArchiveJSON(zw *zip.Writer, name string, v interface{}) error {
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return nil
+}
+
+// writeArchiveMedia copies a stored file into the archive. Media is already
+// compressed, it is stored as is.
+func writeArchiveMedia(ctx context.Context, zw *zip.Writer, key string) error {
+	body, err := storage.Media.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: "media/" + key, Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", key, err)
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		return fmt.Errorf("failed to write %s: %v", key, err)
+	}
+	return nil
+}
+
+// ImportLibrary restores the recipes of an archive made by ExportLibrary.
+// Recipes already in the library (same Source, ExternalID and Part) are
+// skipped, the others get new IDs. Files whose key is used by another recipe
+// are stored under a new name.
+func ImportLibrary(r io.ReaderAt, size int64) (*ImportReport, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, ErrInvalidArchive
+	}
+
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	var manifest ArchiveManifest
+	if err := readArchiveJSON(files["manifest.json"], &manifest); err != nil || manifest.Format != archiveFormat {
+		return nil, ErrInvalidArchive
+	}
+	if manifest.Version > archiveVersion {
+		return nil, ErrUnsupportedArchive
+	}
+
+	var entries []ArchiveRecipe
+	for name, f := range files {
+		if !strings.HasPrefix(name, "recipes/") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		var entry ArchiveRecipe
+		if err := readArchiveJSON(f, &entry); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", name, err)
+		}
+		entries = append(entries, entry)
+	}
+	// Originals before their variants, in the order they were created
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Recipe.ID < entries[j].Recipe.ID })
+
+	imp := &archiveImport{
+		files:  files,
+		keys:   make(map[string]string),
+		stored: make(map[string]bool),
+		stamp:  time.Now().UnixNano(),
+		report: &ImportReport{IDs: make(map[uint]uint)},
+	}
+	variantOf := make(map[uint]uint) // New ID -> original ID in the archive
+	for i := range entries {
+		entry := &entries[i]
+		oldID := entry.Recipe.ID
+
+		var existing models.Recipe
+		err := database.DB.Unscoped().Where("source = ? AND external_id = ? AND part = ?",
+			entry.Recipe.Source, entry.Recipe.ExternalID, entry.Recipe.Part).First(&existing).Error
+		if err == nil {
+			imp.report.IDs[oldID] = existing.ID
+			imp.report.Skipped++
+			continue
+		}
+
+		originalOf := entry.Recipe.VariantOfID
+		if err := imp.importRecipe(entry); err != nil {
+			imp.report.Errors = append(imp.report.Errors, fmt.Sprintf("recipe %d (%s): %v", oldID, entry.Recipe.Title, err))
+			continue
+		}
+		imp.report.IDs[oldID] = entry.Recipe.ID
+		imp.report.Imported++
+		if originalOf != nil {
+			variantOf[entry.Recipe.ID] = *originalOf
+		}
+	}
+
+	// Variants point to the new ID of their original, when it was imported too
+	for id, oldOriginal := range variantOf {
+		if newOriginal, ok := imp.report.IDs[oldOriginal]; ok {
+			database.DB.Model(&models.Recipe{}).Where("id = ?", id).Update("variant_of_id", newOriginal)
+		}
+	}
+
+	log.Printf("Imported %d recipes (%d already in the library, %d media files, %d errors)",
+		imp.report.Imported, imp.report.Skipped, imp.report.MediaFiles, len(imp.report.Errors))
+	return imp.report, nil
+}
+
+func readArchiveJSON(f *zip.File, v interface{}) error {
+	if f == nil {
+		return ErrInvalidArchive
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return json.NewDecoder(rc).Decode(v)
+}
+
+// archiveImport holds the state of an import shared by its recipes.
+type archiveImport struct {
+	files  map[string]*zip.File
+	keys   map[string]string // Key in the archive -> key in the store
+	stored map[string]bool   // Keys already copied to the store
+	stamp  int64             // Prefix of renamed files
+	report *ImportReport
+}
+
+// importRecipe stores the files of a recipe and creates it with new IDs.
+func (imp *archiveImport) importRecipe(entry *ArchiveRecipe) error {
+	recipe := &entry.Recipe
+
+	published, err := imp.importMedia(recipe)
+	if err != nil {
+		return err
+	}
+
+	recipe.ID = 0
+	recipe.UpdatedAt = time.Time{}
+	recipe.DeletedAt = gorm.DeletedAt{}
+	recipe.Version = 1
+	recipe.VariantOfID = nil
+	if recipe.Thumbnails.Card.JPEG != "" {
+		recipe.Thumbnails.Source = recipe.ThumbnailPath
+	}
+	for i := range recipe.Ingredients {
+		recipe.Ingredients[i].Model = gorm.Model{}
+		recipe.Ingredients[i].RecipeID = 0
+	}
+	for i := range recipe.Steps {
+		recipe.Steps[i].Model = gorm.Model{}
+		recipe.Steps[i].RecipeID = 0
+	}
+	for i := range recipe.Tags {
+		recipe.Tags[i].Model = gorm.Model{}
+		recipe.Tags[i].RecipeID = 0
+	}
+	// Reposts can only belong to one recipe
+	var sources []models.RecipeSource
+	for _, s := range recipe.AlternateSources {
+		var count int64
+		database.DB.Model(&models.RecipeSource{}).Where("source = ? AND external_id = ?", s.Source, s.ExternalID).Count(&count)
+		if count == 0 {
+			s.Model = gorm.Model{}
+			s.RecipeID = 0
+			sources = append(sources, s)
+		}
+	}
+	recipe.AlternateSources = sources
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(recipe).Error; err != nil {
+			return err
+		}
+		for _, t := range entry.Translations {
+			t.Model = gorm.Model{}
+			t.RecipeID = recipe.ID
+			// SourceHash only depends on the texts, so it still tells if it's up to date
+			if err := tx.Create(&t).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Files only this recipe would have used
+		for _, key := range published {
+			if !MediaReferenced(key, 0) {
+				storage.Media.Delete(context.Background(), key)
+			}
+		}
+		return fmt.Errorf("failed to save recipe: %v", err)
+	}
+	return nil
+}
+
+// importMedia copies the files of a recipe from the archive to the store and
+// points the recipe to their keys. Files missing from the archive (exported
+// without media) keep their key, in case the store still has them.
+func (imp *archiveImport) importMedia(recipe *models.Recipe) ([]string, error) {
+	remap := func(key string) string {
+		if key == "" || imp.files["media/"+key] == nil {
+			return key
+		}
+		if newKey, ok := imp.keys[key]; ok {
+			return newKey
+		}
+		newKey := key
+		if MediaReferenced(key, 0) {
+			newKey = path.Join(path.Dir(key), fmt.Sprintf("import%d_%s", imp.stamp, path.Base(key)))
+		}
+		imp.keys[key] = newKey
+		return newKey
+	}
+
+	var keys []string
+	var pending []string // Archive keys to extract
+	track := func(oldKey, newKey string) {
+		if oldKey != "" && imp.files["media/"+oldKey] != nil && !imp.stored[newKey] && !containsString(keys, newKey) {
+			keys = append(keys, newKey)
+			pending = append(pending, oldKey)
+		}
+	}
+	set := func(p *string) {
+		old := *p
+		*p = remap(old)
+		track(old, *p)
+	}
+
+	set(&recipe.LocalVideoPath)
+	set(&recipe.OriginalVideoPath)
+	set(&recipe.ThumbnailPath)
+	for _, v := range []*models.ThumbnailVariant{&recipe.Thumbnails.Card, &recipe.Thumbnails.Header} {
+		set(&v.JPEG)
+		set(&v.WebP)
+	}
+	for i := range recipe.Steps {
+		set(&recipe.Steps[i].ImagePath)
+	}
+
+	// The HLS directory is renamed as a whole, the playlist has relative segment names
+	if recipe.StreamPath != "" && imp.files["media/"+recipe.StreamPath] != nil {
+		oldDir := path.Dir(recipe.StreamPath) + "/"
+		newDir, ok := imp.keys[oldDir]
+		if !ok {
+			newDir = oldDir
+			if MediaReferenced(recipe.StreamPath, 0) {
+				newDir = path.Join(path.Dir(path.Dir(recipe.StreamPath)), fmt.Sprintf("import%d_%s", imp.stamp, path.Base(oldDir))) + "/"
+			}
+			imp.keys[oldDir] = newDir
+		}
+		for name := range imp.files {
+			if oldKey := strings.TrimPrefix(name, "media/"); strings.HasPrefix(oldKey, oldDir) {
+				track(oldKey, newDir+strings.TrimPrefix(oldKey, oldDir))
+			}
+		}
+		recipe.StreamPath = newDir + path.Base(recipe.StreamPath)
+	}
+
+	for i, oldKey := range pending {
+		if err := imp.extract(oldKey, keys[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := publishWorkFiles(keys); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		imp.stored[key] = true
+	}
+	imp.report.MediaFiles += len(keys)
+	return keys, nil
+}
+
+// extract writes a media file of the archive to the work directory.
+func (imp *archiveImport) extract(oldKey, newKey string) error {
+	// Only media keys, the work directory also holds the database
+	if key, err := storage.CleanKey(newKey); err != nil || key != newKey || !strings.HasPrefix(key, "videos/") {
+		return fmt.Errorf("invalid media key %q", newKey)
+	}
+	dst := storage.WorkPath(newKey)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	rc, err := imp.files["media/"+oldKey].Open()
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", oldKey, err)
+	}
+	defer rc.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, rc)
+	out.Close()
+	if err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("failed to extract %s: %v", oldKey, err)
+	}
+	return nil
+}
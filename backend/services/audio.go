@@ -0,0 +1,38 @@
+package services
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ExtractAudio uses ffmpeg to pull the audio track out of a video as a
+// 16 kHz mono WAV file (the format expected by whisper.cpp).
+// The WAV is written next to the video and its path is returned.
+func ExtractAudio(videoPath string) (string, error) {
+	audioPath := strings.TrimSuffix(videoPath, filepath.Ext(videoPath)) + ".wav"
+
+	cmd := exec.Command("ffmpeg",
+		"-y",
+		"-i", videoPath,
+		"-vn",
+		"-ac", "1",
+		"-ar", "16000",
+		"-c:a", "pcm_s16le",
+		audioPath,
+	)
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to extract audio: %v (%s)", err, lastLine(out))
+	}
+
+	return audioPath, nil
+}
+
+// lastLine returns the last non-empty line of a command output,
+// which is usually where CLI tools print the actual error.
+func lastLine(out []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,88 @@
+package services
+
+import (
+	"time"
+	"xgastroteca/database"
+	"xgastroteca/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const maxChangesPage = 500
+
+// TouchRecipe bumps UpdatedAt and Version of a recipe whose related rows
+// (tags, alternate sources...) changed, so clients syncing by date get it again.
+func TouchRecipe(recipeID uint) {
+	database.DB.Model(&models.Recipe{}).Where("id = ?", recipeID).UpdateColumns(map[string]interface{}{
+		"updated_at": time.Now(),
+		"version":    NextVersion(),
+	})
+}
+
+// NextVersion is the value of the version column in updates of a recipe.
+func NextVersion() clause.Expr {
+	return gorm.Expr("version + 1")
+}
+
+// OrderByID keeps preloaded children (ingredients, steps) in creation order.
+func OrderByID(db *gorm.DB) *gorm.DB {
+	return db.Order("id asc")
+}
+
+// ChangesCursor is the position of a client in the list of changes: the last
+// UpdatedAt it received and, for rows with the same time, the last ID.
+type ChangesCursor struct {
+	Since   time.Time `json:"since"`
+	AfterID uint      `json:"after_id"`
+}
+
+// RecipeChanges is a page of recipes modified after a cursor.
+type RecipeChanges struct {
+	Recipes      []models.Recipe `json:"data"`
+	Next         ChangesCursor   `json:"next"`     // Cursor for the following request
+	HasMore      bool            `json:"has_more"` // More changes after this page
+	LastModified time.Time       `json:"last_modified"`
+}
+
+// RecipeChangedSince reports whether any recipe was created or modified at or after t.
+func RecipeChangedSince(t time.Time) bool {
+	var count int64
+	database.DB.Model(&models.Recipe{}).Where("updated_at >= ?", t.In(time.Local)).Count(&count)
+	return count > 0
+}
+
+// RecipesChangedSince returns the recipes created or modified after the
+// cursor, oldest change first, with everything the detail endpoint returns.
+func RecipesChangedSince(cursor ChangesCursor, limit int) (*RecipeChanges, error) {
+	if limit < 1 || limit > maxChangesPage {
+		limit = maxChangesPage
+	}
+
+	// Same format as the stored timestamps, which use the server time zone
+	since := cursor.Since.In(time.Local)
+
+	var recipes []models.Recipe
+	err := database.DB.Preload("Ingredients", OrderByID).Preload("Steps", OrderByID).
+		Preload("Tags").Preload("AlternateSources").
+		Where("updated_at > ? OR (updated_at = ? AND id > ?)", since, since, cursor.AfterID).
+		Order("updated_at, id").
+		Limit(limit + 1).
+		Find(&recipes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	changes := &RecipeChanges{Next: cursor, LastModified: cursor.Since}
+	if len(recipes) > limit {
+		recipes = recipes[:limit]
+		changes.HasMore = true
+	}
+	if len(recipes) > 0 {
+		last := recipes[len(recipes)-1]
+		changes.Next = ChangesCursor{Since: last.UpdatedAt, AfterID: last.ID}
+		changes.LastModified = last.UpdatedAt
+	}
+	changes.Recipes = recipes
+	return changes, nil
+}
@@ -0,0 +1,240 @@
+package services
+
+import (
+	"log"
+	"strings"
+	"xgastroteca/database"
+	"xgastroteca/models"
+)
+
+// Allergen names accepted by the API
+const (
+	AllergenGluten    = "gluten"
+	AllergenLactose   = "lactose"
+	AllergenNuts      = "nuts"
+	AllergenEgg       = "egg"
+	AllergenShellfish = "shellfish"
+	AllergenFish      = "fish"
+)
+
+// Non-allergen categories used to compute the diets
+const (
+	categoryMeat  = "meat"
+	categoryHoney = "honey"
+)
+
+// dietaryRule flags an ingredient when any keyword appears as a whole word.
+// Exceptions are phrases that contain a keyword without meaning it ("leche
+// de coco"), they are ignored but the rest of the text is still checked.
+// Qualifiers exclude the whole ingredient ("sin gluten").
+type dietaryRule struct {
+	Category   string
+	Keywords   []string
+	Exceptions []string
+	Qualifiers []string
+}
+
+var dietaryRules = []dietaryRule{
+	{
+		Category: AllergenGluten,
+		Keywords: []string{"harina", "trigo", "pan", "pan rallado", "pasta", "espaguetis", "macarrones", "fideos", "tallarines", "lasana",
+			"cuscus", "cebada", "centeno", "espelta", "galleta", "galletas", "bizcocho", "hojaldre", "masa quebrada", "cerveza", "seitan",
+			"avena", "salsa de soja", "tortilla de trigo", "flour", "wheat", "bread", "breadcrumbs", "panko", "noodles", "spaghetti",
+			"couscous", "barley", "rye", "spelt", "beer", "cookies", "biscuits", "puff pastry", "oats"},
+		Exceptions: []string{"harina de maiz", "harina de arroz", "harina de almendra", "harina de garbanzo",
+			"harina de coco", "pan de maiz", "corn flour", "rice flour", "almond flour", "tamari"},
+		Qualifiers: []string{"sin gluten", "gluten free"},
+	},
+	{
+		Category: AllergenLactose,
+		Keywords: []string{"leche", "nata", "mantequilla", "queso", "yogur", "yogurt", "crema de leche", "mascarpone", "requeson", "ricotta",
+			"mozzarella", "parmesano", "bechamel", "ghee", "suero", "milk", "butter", "cheese", "cream", "yoghurt", "parmesan", "buttermilk"},
+		Exceptions: []string{"leche de coco", "leche de almendra", "leche de avena", "leche de soja",
+			"leche de arroz", "bebida vegetal", "bebida de avena", "coconut milk", "almond milk", "oat milk", "soy milk", "queso vegano",
+			"mantequilla de cacahuete", "peanut butter", "crema de cacahuete", "cream of tartar"},
+		Qualifiers: []string{"sin lactosa", "lactose free", "vegan"},
+	},
+	{
+		Category: AllergenNuts,
+		Keywords: []string{"almendra", "almendras", "nuez", "nueces", "avellana", "avellanas", "anacardo", "anacardos", "pistacho", "pistachos",
+			"pinones", "pecana", "pecanas", "macadamia", "cacahuete", "cacahuetes", "mani", "nutella", "praline", "almond", "almonds",
+			"walnut", "walnuts", "hazelnut", "hazelnuts", "cashew", "cashews", "pistachio", "pistachios", "pecan", "pecans", "peanut",
+			"peanuts", "pine nuts"},
+		Exceptions: []string{"nuez moscada", "nutmeg"},
+	},
+	{
+		Category:   AllergenEgg,
+		Keywords:   []string{"huevo", "huevos", "clara", "claras", "yema", "yemas", "mayonesa", "merengue", "egg", "eggs", "mayonnaise", "meringue"},
+		Exceptions: []string{"mayonesa vegana", "vegan mayo"},
+		Qualifiers: []string{"sin huevo", "egg free"},
+	},
+	{
+		Category: AllergenShellfish,
+		Keywords: []string{"gamba", "gambas", "langostino", "langostinos", "camaron", "camarones", "mejillon", "mejillones", "almeja", "almejas",
+			"calamar", "calamares", "pulpo", "sepia", "cangrejo", "bogavante", "langosta", "vieira", "vieiras", "ostra", "ostras",
+			"berberechos", "navajas", "shrimp", "prawn", "prawns", "crab", "lobster", "mussel", "mussels", "clam", "clams", "oyster",
+			"oysters", "squid", "octopus", "scallop", "scallops"},
+	},
+	{
+		Category: AllergenFish,
+		Keywords: []string{"pescado", "salmon", "atun", "bonito", "merluza", "bacalao", "anchoa", "anchoas", "boquerones", "sardina", "sardinas",
+			"lubina", "dorada", "trucha", "rape", "caballa", "fumet", "salsa de pescado", "fish", "tuna", "cod", "anchovy", "anchovies",
+			"sardines", "trout", "mackerel", "fish sauce"},
+	},
+	{
+		Category: categoryMeat,
+		Keywords: []string{"carne", "pollo", "ternera", "cerdo", "cordero", "pavo", "jamon", "bacon", "beicon", "panceta", "tocino", "chorizo",
+			"salchicha", "salchichas", "lomo", "solomillo", "costillas", "conejo", "pato", "morcilla", "salami", "pepperoni", "sobrasada",
+			"gelatina", "manteca de cerdo", "caldo de pollo", "caldo de carne", "pechuga", "muslos", "chicken", "beef", "pork", "lamb",
+			"turkey", "ham", "sausage", "sausages", "duck", "gelatin", "lard", "meat"},
+		Exceptions: []string{"carne vegetal", "gelatina vegetal"},
+		Qualifiers: []string{"vegan", "vegana", "vegano", "soja texturizada", "agar"},
+	},
+	{
+		Category: categoryHoney,
+		Keywords: []string{"miel", "honey"},
+	},
+}
+
+// AllergenNames lists the allergens that can be used in filters and overrides.
+var AllergenNames = []string{AllergenGluten, AllergenLactose, AllergenNuts, AllergenEgg, AllergenShellfish, AllergenFish}
+
+// IsAllergen reports whether name is a known allergen.
+func IsAllergen(name string) bool {
+	for _, a := range AllergenNames {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ClassifyIngredient returns the categories (allergens, meat, honey) of an ingredient name.
+func ClassifyIngredient(item string) []string {
+	text := normalizeFoodText(item)
+
+	var categories []string
+	for _, rule := range dietaryRules {
+		if containsAnyWord(text, rule.Qualifiers) {
+			continue
+		}
+		// "harina de maiz y harina de trigo" still has gluten
+		if containsAnyWord(removeWords(text, rule.Exceptions), rule.Keywords) {
+			categories = append(categories, rule.Category)
+		}
+	}
+	return categories
+}
+
+func containsAnyWord(text string, words []string) bool {
+	for _, w := range words {
+		if strings.Contains(text, " "+w+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// removeWords removes whole word phrases from a normalized text.
+func removeWords(text string, phrases []string) string {
+	for _, p := range phrases {
+		// Repeated because adjacent occurrences share the space between them
+		for strings.Contains(text, " "+p+" ") {
+			text = strings.ReplaceAll(text, " "+p+" ", " ")
+		}
+	}
+	return text
+}
+
+// ClassifyDiet computes the dietary info of a list of ingredients and,
+// for each allergen/category, the ingredients that triggered it. Without
+// ingredients there is nothing to tell, the diets are left unset.
+func ClassifyDiet(ingredients []models.Ingredient) (models.DietaryInfo, map[string][]string) {
+	triggers := make(map[string][]string)
+	if len(ingredients) == 0 {
+		return models.DietaryInfo{Classified: true}, triggers
+	}
+	for _, ing := range ingredients {
+		for _, cat := range ClassifyIngredient(ing.Item) {
+			triggers[cat] = append(triggers[cat], ing.Item)
+		}
+	}
+
+	var allergens []string
+	for _, a := range AllergenNames {
+		if len(triggers[a]) > 0 {
+			allergens = append(allergens, a)
+		}
+	}
+
+	hasAnimal := len(triggers[categoryMeat]) > 0 || len(triggers[AllergenFish]) > 0 || len(triggers[AllergenShellfish]) > 0
+	vegetarian := !hasAnimal
+	vegan := vegetarian && len(triggers[AllergenEgg]) == 0 && len(triggers[AllergenLactose]) == 0 && len(triggers[categoryHoney]) == 0
+
+	return models.DietaryInfo{
+		Allergens:  strings.Join(allergens, ","),
+		Vegetarian: vegetarian,
+		Vegan:      vegan,
+		Classified: true,
+	}, triggers
+}
+
+// ClassifyRecipe updates recipe.Dietary from its ingredients unless the user overrode it.
+func ClassifyRecipe(recipe *models.Recipe) {
+	if recipe.Dietary.Override {
+		return
+	}
+	recipe.Dietary, _ = ClassifyDiet(recipe.Ingredients)
+}
+
+// NormalizeAllergens validates a list of allergens and returns it sorted
+// in the canonical order as stored in DietaryInfo.Allergens.
+func NormalizeAllergens(list []string) (string, bool) {
+	set := make(map[string]bool)
+	for _, a := range list {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if a == "" {
+			continue
+		}
+		if !IsAllergen(a) {
+			return "", false
+		}
+		set[a] = true
+	}
+
+	var allergens []string
+	for _, a := range AllergenNames {
+		if set[a] {
+			allergens = append(allergens, a)
+		}
+	}
+	return strings.Join(allergens, ","), true
+}
+
+// SaveDietary persists the dietary info of a recipe.
+func SaveDietary(recipe *models.Recipe) error {
+	d := recipe.Dietary
+	return database.DB.Model(&models.Recipe{}).Where("id = ?", recipe.ID).Updates(map[string]interface{}{
+		"dietary_allergens":  d.Allergens,
+		"dietary_vegetarian": d.Vegetarian,
+		"dietary_vegan":      d.Vegan,
+		"dietary_override":   d.Override,
+		"dietary_classified": d.Classified,
+		"version":            NextVersion(),
+	}).Error
+}
+
+// ClassifyPendingRecipes classifies the recipes created before the classifier existed.
+func ClassifyPendingRecipes() {
+	var recipes []models.Recipe
+	database.DB.Preload("Ingredients").Where("dietary_classified = ? OR dietary_classified IS NULL", false).Find(&recipes)
+	for i := range recipes {
+		ClassifyRecipe(&recipes[i])
+		if err := SaveDietary(&recipes[i]); err != nil {
+			log.Printf("Failed to classify recipe %d: %v", recipes[i].ID, err)
+		}
+	}
+	if len(recipes) > 0 {
+		log.Printf("Dietary classification computed for %d recipes", len(recipes))
+	}
+}
@@ -0,0 +1,314 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"xgastroteca/models"
+	"xgastroteca/utils"
+)
+
+const (
+	defaultDownloadTimeout = 10 * time.Minute
+	defaultMaxHeight       = 1080
+)
+
+// Downloader fetches the video of a post, with its thumbnail and metadata.
+type Downloader interface {
+	Download(ctx context.Context, req DownloadRequest) (*DownloadResult, error)
+}
+
+// DownloadRequest describes a video to download.
+type DownloadRequest struct {
+	URL        string
+	Source     string // Registry name (youtube, instagram...), selects cookies and options
+	OutputPath string // Video file to write, e.g. ./data/videos/video_123.mp4
+}
+
+// DownloadResult lists the files written next to OutputPath. Thumbnail and
+// info are empty when the platform doesn't provide them.
+type DownloadResult struct {
+	VideoPath     string
+	ThumbnailPath string // <base>.jpg
+	InfoPath      string // <base>.info.json
+}
+
+// Kinds of download failures, used to give a useful answer to the user
+const (
+	DownloadLoginRequired = "login_required"
+	DownloadPrivate       = "private"
+	DownloadAgeRestricted = "age_restricted"
+	DownloadGeoBlocked    = "geo_blocked"
+	DownloadNotFound      = "not_found"
+	DownloadUnavailable   = "unavailable"
+	DownloadRateLimited   = "rate_limited"
+	DownloadTooLarge      = "too_large"
+	DownloadTimeout       = "timeout"
+	DownloadUnknown       = "unknown"
+)
+
+// DownloadError is a failed download with the reason reported by yt-dlp.
+type DownloadError struct {
+	Kind    string
+	Message string // Last error line of yt-dlp
+}
+
+func (e *DownloadError) Error() string {
+	return fmt.Sprintf("failed to download video (%s): %s", e.Kind, e.Message)
+}
+
+// Known yt-dlp messages for each kind, checked in order against the lowercase output
+var downloadErrorPatterns = []struct {
+	kind     string
+	patterns []string
+}{
+	{DownloadAgeRestricted, []string{"confirm your age", "age-restricted", "age restricted", "inappropriate for some users"}},
+	{DownloadPrivate, []string{"private video", "video is private", "this account is private", "private account"}},
+	{DownloadLoginRequired, []string{"login required", "log in to", "sign in to", "--cookies", "authentication", "not a bot"}},
+	{DownloadRateLimited, []string{"http error 429", "too many requests", "rate-limit", "rate limit"}},
+	{DownloadGeoBlocked, []string{"available in your country", "geo restrict", "geo-restrict", "geoblock"}},
+	{DownloadTooLarge, []string{"larger than max-filesize"}},
+	{DownloadNotFound, []string{"http error 404", "does not exist", "page not found", "has been removed", "been deleted"}},
+	{DownloadUnavailable, []string{"video unavailable", "video not available", "is not available", "no video formats", "unsupported url", "there is no video"}},
+}
+
+// classifyDownloadError turns the output of a failed yt-dlp run into a DownloadError.
+func classifyDownloadError(output string) *DownloadError {
+	lower := strings.ToLower(output)
+	kind := DownloadUnknown
+	for _, group := range downloadErrorPatterns {
+		for _, p := range group.patterns {
+			if strings.Contains(lower, p) {
+				kind = group.kind
+				break
+			}
+		}
+		if kind != DownloadUnknown {
+			break
+		}
+	}
+
+	// The last ERROR line is the most specific message
+	message := lastLine([]byte(output))
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "ERROR:") {
+			message = strings.TrimSpace(strings.TrimPrefix(line, "ERROR:"))
+		}
+	}
+	return &DownloadError{Kind: kind, Message: message}
+}
+
+// YtDlpDownloader downloads videos with yt-dlp.
+type YtDlpDownloader struct {
+	BinaryPath         string
+	Timeout            time.Duration
+	CookiesFile        string            // Netscape cookies file used for every platform
+	CookiesFromBrowser string            // e.g. "firefox" or "chrome:Profile 1"
+	SourceCookies      map[string]string // Cookies file per platform, preferred over CookiesFile
+	Proxy              string            // e.g. socks5://127.0.0.1:1080
+	MaxHeight          int               // Max video height in pixels, 0 for no limit
+	MaxFilesize        string            // yt-dlp size, e.g. "500M", empty for no limit
+}
+
+// NewDownloader builds the downloader configured in the environment:
+// yt-dlp by default, or the fake one when DOWNLOADER=fake (offline runs).
+func NewDownloader() Downloader {
+	if os.Getenv("DOWNLOADER") == "fake" {
+		return &FakeDownloader{VideoPath: os.Getenv("FAKE_DOWNLOAD_VIDEO")}
+	}
+	return NewYtDlpDownloader()
+}
+
+// NewYtDlpDownloader reads the yt-dlp settings from the environment.
+func NewYtDlpDownloader() *YtDlpDownloader {
+	d := &YtDlpDownloader{
+		BinaryPath:         os.Getenv("YTDLP_BIN"),
+		Timeout:            defaultDownloadTimeout,
+		CookiesFile:        os.Getenv("YTDLP_COOKIES"),
+		CookiesFromBrowser: os.Getenv("YTDLP_COOKIES_FROM_BROWSER"),
+		SourceCookies:      make(map[string]string),
+		Proxy:              os.Getenv("YTDLP_PROXY"),
+		MaxHeight:          defaultMaxHeight,
+		MaxFilesize:        os.Getenv("YTDLP_MAX_FILESIZE"),
+	}
+	if d.BinaryPath == "" {
+		d.BinaryPath = "yt-dlp"
+	}
+	if secs, err := strconv.Atoi(os.Getenv("YTDLP_TIMEOUT")); err == nil && secs > 0 {
+		d.Timeout = time.Duration(secs) * time.Second
+	}
+	if h, err := strconv.Atoi(os.Getenv("YTDLP_MAX_HEIGHT")); err == nil && h >= 0 {
+		d.MaxHeight = h
+	}
+
+	// e.g. YTDLP_COOKIES_INSTAGRAM=./data/cookies/instagram.txt
+	for _, src := range utils.Sources() {
+		if path := os.Getenv("YTDLP_COOKIES_" + strings.ToUpper(src.Name)); path != "" {
+			d.SourceCookies[src.Name] = path
+		}
+	}
+	return d
+}
+
+// args builds the yt-dlp command line for a request.
+func (d *YtDlpDownloader) args(req DownloadRequest) []string {
+	format := "bestvideo+bestaudio/best"
+	if d.MaxHeight > 0 {
+		format = fmt.Sprintf("bestvideo[height<=%d]+bestaudio/best[height<=%d]/best", d.MaxHeight, d.MaxHeight)
+	}
+
+	args := []string{
+		"-o", req.OutputPath,
+		"-f", format,
+		"--merge-output-format", "mp4",
+		"--write-thumbnail",
+		"--convert-thumbnails", "jpg",
+		"--write-info-json",
+		"--no-progress",
+	}
+	if d.MaxFilesize != "" {
+		args = append(args, "--max-filesize", d.MaxFilesize)
+	}
+	if d.Proxy != "" {
+		args = append(args, "--proxy", d.Proxy)
+	}
+
+	switch {
+	case d.SourceCookies[req.Source] != "":
+		args = append(args, "--cookies", d.SourceCookies[req.Source])
+	case d.CookiesFile != "":
+		args = append(args, "--cookies", d.CookiesFile)
+	case d.CookiesFromBrowser != "":
+		args = append(args, "--cookies-from-browser", d.CookiesFromBrowser)
+	}
+
+	if src := utils.FindSource(req.Source); src != nil {
+		args = append(args, src.DownloadArgs...)
+	}
+	return append(args, req.URL)
+}
+
+// Download runs yt-dlp, stopping it when ctx is cancelled or the timeout expires.
+func (d *YtDlpDownloader) Download(ctx context.Context, req DownloadRequest) (*DownloadResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.Timeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, d.BinaryPath, d.args(req)...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, &DownloadError{Kind: DownloadTimeout, Message: fmt.Sprintf("no answer after %s", d.Timeout)}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		dlErr := classifyDownloadError(output.String())
+		log.Printf("yt-dlp failed (%s): %v\n%s", dlErr.Kind, err, output.String())
+		return nil, dlErr
+	}
+
+	// yt-dlp exits fine when it skips a file over --max-filesize
+	if _, err := os.Stat(req.OutputPath); err != nil {
+		dlErr := classifyDownloadError(output.String())
+		if dlErr.Kind == DownloadUnknown {
+			dlErr.Message = "yt-dlp did not write the video file"
+		}
+		return nil, dlErr
+	}
+
+	return downloadResult(req.OutputPath), nil
+}
+
+// downloadResult lists the files written for a video.
+func downloadResult(videoPath string) *DownloadResult {
+	base := strings.TrimSuffix(videoPath, filepath.Ext(videoPath))
+	result := &DownloadResult{VideoPath: videoPath}
+	if _, err := os.Stat(base + ".jpg"); err == nil {
+		result.ThumbnailPath = base + ".jpg"
+	}
+	if _, err := os.Stat(base + ".info.json"); err == nil {
+		result.InfoPath = base + ".info.json"
+	}
+	return result
+}
+
+// removeDownloadFiles deletes what a failed download left behind: the video,
+// its partial files and fragments, the info JSON and the thumbnail.
+func removeDownloadFiles(videoPath string) {
+	base := strings.TrimSuffix(videoPath, filepath.Ext(videoPath))
+	leftovers, _ := filepath.Glob(base + ".*")
+	for _, path := range append(leftovers, videoPath) {
+		os.Remove(path)
+	}
+}
+
+// FakeDownloader copies a local video instead of downloading, for offline
+// development and tests. Err, when set, is returned for every request.
+type FakeDownloader struct {
+	VideoPath string                 // Local file copied to the output path
+	Info      *models.SourceMetadata // Written as <base>.info.json when set
+	Err       error
+}
+
+// Download copies VideoPath to the requested output path.
+func (f *FakeDownloader) Download(ctx context.Context, req DownloadRequest) (*DownloadResult, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	if f.VideoPath == "" {
+		return nil, errors.New("fake downloader has no video configured (FAKE_DOWNLOAD_VIDEO)")
+	}
+
+	src, err := os.Open(f.VideoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open fake video: %v", err)
+	}
+	defer src.Close()
+
+	dst, err := os.Create(req.OutputPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create video file: %v", err)
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return nil, fmt.Errorf("failed to copy fake video: %v", err)
+	}
+
+	if f.Info != nil {
+		info := ytDlpInfo{
+			Description: f.Info.Caption,
+			Uploader:    f.Info.Uploader,
+			UploadDate:  f.Info.UploadDate,
+			Duration:    f.Info.Duration,
+			WebpageURL:  f.Info.OriginalURL,
+		}
+		if info.WebpageURL == "" {
+			info.WebpageURL = req.URL
+		}
+		if f.Info.Hashtags != "" {
+			info.Tags = strings.Split(f.Info.Hashtags, ",")
+		}
+		data, _ := json.Marshal(info)
+		base := strings.TrimSuffix(req.OutputPath, filepath.Ext(req.OutputPath))
+		if err := os.WriteFile(base+".info.json", data, 0644); err != nil {
+			return nil, fmt.Errorf("failed to write fake info: %v", err)
+		}
+	}
+
+	return downloadResult(req.OutputPath), nil
+}
@@ -0,0 +1,323 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"xgastroteca/models"
+)
+
+func TestClassifyDownloadError(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		kind    string
+		message string
+	}{
+		{
+			name:    "instagram login",
+			output:  "[Instagram] Extracting URL: https://www.instagram.com/reel/C3xyz/\n[Instagram] C3xyz: Setting up session\nERROR: [Instagram] C3xyz: Requested content is not available, rate-limit reached or login required. Use --cookies, --cookies-from-browser, --username and --password, --netrc-cmd, or --netrc (instagram) to provide account credentials\n",
+			kind:    DownloadLoginRequired,
+			message: "[Instagram] C3xyz: Requested content is not available, rate-limit reached or login required. Use --cookies, --cookies-from-browser, --username and --password, --netrc-cmd, or --netrc (instagram) to provide account credentials",
+		},
+		{
+			name:   "youtube bot check",
+			output: "[youtube] Extracting URL: https://www.youtube.com/watch?v=abc\nERROR: [youtube] abc: Sign in to confirm you’re not a bot. Use --cookies-from-browser or --cookies for the authentication. See  https://github.com/yt-dlp/yt-dlp/wiki/FAQ#how-do-i-pass-cookies-to-yt-dlp  for how to manually pass cookies. Also see  https://github.com/yt-dlp/yt-dlp/wiki/Extractors#exporting-youtube-cookies  for tips on effectively exporting YouTube cookies\n",
+			kind:   DownloadLoginRequired,
+		},
+		{
+			name:    "youtube age",
+			output:  "WARNING: [youtube] abc: nsig extraction failed: Some formats may be missing\nERROR: [youtube] abc: Sign in to confirm your age. This video may be inappropriate for some users. Use --cookies-from-browser or --cookies for the authentication.\n",
+			kind:    DownloadAgeRestricted,
+			message: "[youtube] abc: Sign in to confirm your age. This video may be inappropriate for some users. Use --cookies-from-browser or --cookies for the authentication.",
+		},
+		{
+			name:   "youtube private",
+			output: "ERROR: [youtube] abc: Private video. Sign in if you've been granted access to this video. Use --cookies-from-browser or --cookies for the authentication.\n",
+			kind:   DownloadPrivate,
+		},
+		{
+			name:   "youtube geo",
+			output: "ERROR: [youtube] abc: Video unavailable. The uploader has not made this video available in your country\n",
+			kind:   DownloadGeoBlocked,
+		},
+		{
+			name:   "geo restriction",
+			output: "ERROR: [vimeo] 123: This video is not available from your location due to geo restriction\n",
+			kind:   DownloadGeoBlocked,
+		},
+		{
+			name:   "tiktok rate limit",
+			output: "ERROR: [TikTok] 7301234567890: Unable to download webpage: HTTP Error 429: Too Many Requests (caused by <HTTPError 429: Too Many Requests>)\n",
+			kind:   DownloadRateLimited,
+		},
+		{
+			name:   "tiktok not available",
+			output: "ERROR: [TikTok] 7301234567890: Video not available, status code 10204\n",
+			kind:   DownloadUnavailable,
+		},
+		{
+			name:   "removed",
+			output: "ERROR: [youtube] abc: Video unavailable. This video has been removed by the uploader\n",
+			kind:   DownloadNotFound,
+		},
+		{
+			name:   "http 404",
+			output: "ERROR: [generic] Unable to download webpage: HTTP Error 404: Not Found (caused by <HTTPError 404: Not Found>)\n",
+			kind:   DownloadNotFound,
+		},
+		{
+			name:   "unsupported url",
+			output: "WARNING: [generic] Falling back on generic information extractor\nERROR: Unsupported URL: https://example.com/recipe\n",
+			kind:   DownloadUnavailable,
+		},
+		{
+			name:    "max filesize",
+			output:  "[info] abc: Downloading 1 format(s): 137+140\n[download] File is larger than max-filesize (52428800 bytes > 10485760 bytes). Aborting.\n",
+			kind:    DownloadTooLarge,
+			message: "[download] File is larger than max-filesize (52428800 bytes > 10485760 bytes). Aborting.",
+		},
+		{
+			name:    "missing ffmpeg",
+			output:  "ERROR: Postprocessing: ffprobe and ffmpeg not found. Please install or provide the path using --ffmpeg-location\n",
+			kind:    DownloadUnknown,
+			message: "Postprocessing: ffprobe and ffmpeg not found. Please install or provide the path using --ffmpeg-location",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyDownloadError(tt.output)
+			if err.Kind != tt.kind {
+				t.Errorf("kind = %q, want %q", err.Kind, tt.kind)
+			}
+			if tt.message != "" && err.Message != tt.message {
+				t.Errorf("message = %q, want %q", err.Message, tt.message)
+			}
+		})
+	}
+}
+
+func TestYtDlpDownloaderArgs(t *testing.T) {
+	tests := []struct {
+		name       string
+		downloader YtDlpDownloader
+		source     string
+		want       []string // Consecutive arguments expected in the command line
+		absent     []string
+	}{
+		{
+			name:       "height limit",
+			downloader: YtDlpDownloader{MaxHeight: 720},
+			want:       []string{"-f", "bestvideo[height<=720]+bestaudio/best[height<=720]/best"},
+			absent:     []string{"--max-filesize", "--proxy", "--cookies", "--cookies-from-browser"},
+		},
+		{
+			name:       "no height limit",
+			downloader: YtDlpDownloader{},
+			want:       []string{"-f", "bestvideo+bestaudio/best"},
+		},
+		{
+			name:       "size limit",
+			downloader: YtDlpDownloader{MaxFilesize: "500M"},
+			want:       []string{"--max-filesize", "500M"},
+		},
+		{
+			name:       "proxy",
+			downloader: YtDlpDownloader{Proxy: "socks5://127.0.0.1:1080"},
+			want:       []string{"--proxy", "socks5://127.0.0.1:1080"},
+		},
+		{
+			name: "platform cookies first",
+			downloader: YtDlpDownloader{
+				CookiesFile:        "all.txt",
+				CookiesFromBrowser: "firefox",
+				SourceCookies:      map[string]string{"instagram": "instagram.txt"},
+			},
+			source: "instagram",
+			want:   []string{"--cookies", "instagram.txt"},
+			absent: []string{"--cookies-from-browser"},
+		},
+		{
+			name: "shared cookies file",
+			downloader: YtDlpDownloader{
+				CookiesFile:        "all.txt",
+				CookiesFromBrowser: "firefox",
+				SourceCookies:      map[string]string{"instagram": "instagram.txt"},
+			},
+			source: "tiktok",
+			want:   []string{"--cookies", "all.txt"},
+			absent: []string{"--cookies-from-browser"},
+		},
+		{
+			name:       "browser cookies",
+			downloader: YtDlpDownloader{CookiesFromBrowser: "chrome:Profile 1"},
+			want:       []string{"--cookies-from-browser", "chrome:Profile 1"},
+			absent:     []string{"--cookies"},
+		},
+		{
+			name:       "platform options",
+			downloader: YtDlpDownloader{},
+			source:     "youtube",
+			want:       []string{"--no-playlist"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := DownloadRequest{URL: "https://example.com/v/1", Source: tt.source, OutputPath: "/tmp/video_1.mp4"}
+			args := tt.downloader.args(req)
+
+			if args[len(args)-1] != req.URL {
+				t.Errorf("last argument = %q, want the URL", args[len(args)-1])
+			}
+			if !containsSequence(args, []string{"-o", req.OutputPath}) {
+				t.Errorf("args %q don't write to the output path", args)
+			}
+			if !containsSequence(args, tt.want) {
+				t.Errorf("args %q don't contain %q", args, tt.want)
+			}
+			for _, a := range tt.absent {
+				if containsSequence(args, []string{a}) {
+					t.Errorf("args %q contain %q", args, a)
+				}
+			}
+		})
+	}
+}
+
+func containsSequence(args, seq []string) bool {
+	for i := 0; i+len(seq) <= len(args); i++ {
+		match := true
+		for j := range seq {
+			if args[i+j] != seq[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFakeDownloaderPipeline(t *testing.T) {
+	dir := t.TempDir()
+	video := filepath.Join(dir, "sample.mp4")
+	if err := os.WriteFile(video, []byte("not really a video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		fake     *FakeDownloader
+		wantErr  error
+		wantMeta *models.SourceMetadata
+	}{
+		{
+			name: "with metadata",
+			fake: &FakeDownloader{VideoPath: video, Info: &models.SourceMetadata{
+				Caption:    "Tortilla de patatas #tortilla",
+				Uploader:   "chef",
+				UploadDate: "20240131",
+				Duration:   42,
+				Hashtags:   "receta",
+			}},
+			wantMeta: &models.SourceMetadata{
+				Caption:     "Tortilla de patatas #tortilla",
+				Uploader:    "chef",
+				UploadDate:  "20240131",
+				Duration:    42,
+				OriginalURL: "https://example.com/v/1",
+				Hashtags:    "tortilla,receta",
+			},
+		},
+		{
+			name: "without metadata",
+			fake: &FakeDownloader{VideoPath: video},
+		},
+		{
+			name:    "download error",
+			fake:    &FakeDownloader{VideoPath: video, Err: &DownloadError{Kind: DownloadPrivate, Message: "private"}},
+			wantErr: &DownloadError{},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(dir, fmt.Sprintf("video_%d.mp4", i))
+			var downloader Downloader = tt.fake
+			result, err := downloader.Download(context.Background(), DownloadRequest{URL: "https://example.com/v/1", OutputPath: out})
+
+			if tt.wantErr != nil {
+				var dlErr *DownloadError
+				if !errors.As(err, &dlErr) || dlErr.Kind != DownloadPrivate {
+					t.Fatalf("err = %v, want a private DownloadError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("download failed: %v", err)
+			}
+
+			if data, err := os.ReadFile(result.VideoPath); err != nil || string(data) != "not really a video" {
+				t.Errorf("video not copied to %s: %v", result.VideoPath, err)
+			}
+			if tt.wantMeta == nil {
+				if result.InfoPath != "" {
+					t.Errorf("info path = %q, want none", result.InfoPath)
+				}
+				return
+			}
+
+			meta, err := LoadSourceMetadata(result.InfoPath)
+			if err != nil {
+				t.Fatalf("failed to load metadata: %v", err)
+			}
+			if *meta != *tt.wantMeta {
+				t.Errorf("metadata = %+v, want %+v", *meta, *tt.wantMeta)
+			}
+		})
+	}
+}
+
+func TestNewDownloaderFake(t *testing.T) {
+	t.Setenv("DOWNLOADER", "fake")
+	t.Setenv("FAKE_DOWNLOAD_VIDEO", "/videos/sample.mp4")
+
+	fake, ok := NewDownloader().(*FakeDownloader)
+	if !ok {
+		t.Fatalf("DOWNLOADER=fake didn't select the fake downloader")
+	}
+	if fake.VideoPath != "/videos/sample.mp4" {
+		t.Errorf("video path = %q, want FAKE_DOWNLOAD_VIDEO", fake.VideoPath)
+	}
+}
+
+func TestRemoveDownloadFiles(t *testing.T) {
+	dir := t.TempDir()
+	leftovers := []string{"video_1.mp4.part", "video_1.f137.mp4.part-Frag3", "video_1.info.json", "video_1.jpg"}
+	others := []string{"video_12.mp4", "video_12.jpg", "video_2.mp4"}
+	for _, name := range append(leftovers, others...) {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removeDownloadFiles(filepath.Join(dir, "video_1.mp4"))
+
+	for _, name := range leftovers {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed", name)
+		}
+	}
+	for _, name := range others {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s of another download was removed", name)
+		}
+	}
+}
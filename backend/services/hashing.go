@@ -0,0 +1,202 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"log"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Positions (fraction of the duration) of the frames used for the perceptual hash
+var perceptualHashPositions = []float64{0.1, 0.25, 0.4, 0.5, 0.6, 0.75, 0.9}
+
+const (
+	// Max differing bits (out of 64) for two frames to be considered the same
+	perceptualHashMaxDistance = 6
+
+	// Frames both videos must have with enough detail to compare them
+	perceptualHashMinFrames = 4
+
+	// Frames whose luminance varies less than this (standard deviation, out of
+	// 65535) are black intros or solid title cards that every video shares
+	perceptualHashMinDeviation = 2000
+
+	// Max difference in seconds between the durations of two copies of a video
+	perceptualHashMaxDurationDiff = 1.0
+
+	// Hash of a frame skipped for having too little detail
+	skippedFrameHash = "x"
+)
+
+// HashFile returns the hex SHA-256 of a file.
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// PerceptualHash computes a dHash for several keyframes of the video and
+// joins them with the duration as "12.3:hash1-hash2-...". Re-encoded or
+// resized copies of the same video produce hashes within a small Hamming
+// distance. Frames without detail are stored as "x". Returns "" on failure
+// or when too few frames have detail to tell the video apart.
+func PerceptualHash(videoPath string) string {
+	duration, err := ProbeDuration(videoPath)
+	if err != nil {
+		log.Printf("Skipping perceptual hash: %v", err)
+		return ""
+	}
+
+	var hashes []string
+	informative := 0
+	for i, pos := range perceptualHashPositions {
+		framePath := fmt.Sprintf("%s_phash_%d.jpg", strings.TrimSuffix(videoPath, filepath.Ext(videoPath)), i)
+		err := ExtractFrameAt(videoPath, duration*pos, framePath)
+		if err != nil {
+			log.Printf("Skipping perceptual hash: %v", err)
+			return ""
+		}
+		hash, detailed, err := dHashFile(framePath)
+		os.Remove(framePath)
+		if err != nil {
+			log.Printf("Skipping perceptual hash: %v", err)
+			return ""
+		}
+		if !detailed {
+			hashes = append(hashes, skippedFrameHash)
+			continue
+		}
+		informative++
+		hashes = append(hashes, fmt.Sprintf("%016x", hash))
+	}
+	if informative < perceptualHashMinFrames {
+		log.Printf("Skipping perceptual hash: only %d frames with detail", informative)
+		return ""
+	}
+	return fmt.Sprintf("%.1f:%s", duration, strings.Join(hashes, "-"))
+}
+
+// PerceptualHashesMatch reports whether a and b are the same video: durations
+// within a second and every frame with detail in both close enough. A match
+// on the frames alone is not enough, many videos share a similar look.
+func PerceptualHashesMatch(a, b string) bool {
+	durationA, framesA, okA := strings.Cut(a, ":")
+	durationB, framesB, okB := strings.Cut(b, ":")
+	if !okA || !okB {
+		return false
+	}
+	da, errA := strconv.ParseFloat(durationA, 64)
+	db, errB := strconv.ParseFloat(durationB, 64)
+	if errA != nil || errB != nil || math.Abs(da-db) > perceptualHashMaxDurationDiff {
+		return false
+	}
+
+	partsA := strings.Split(framesA, "-")
+	partsB := strings.Split(framesB, "-")
+	if len(partsA) != len(partsB) {
+		return false
+	}
+	compared := 0
+	for i := range partsA {
+		if partsA[i] == skippedFrameHash || partsB[i] == skippedFrameHash {
+			continue
+		}
+		ha, errA := strconv.ParseUint(partsA[i], 16, 64)
+		hb, errB := strconv.ParseUint(partsB[i], 16, 64)
+		if errA != nil || errB != nil {
+			return false
+		}
+		if bits.OnesCount64(ha^hb) > perceptualHashMaxDistance {
+			return false
+		}
+		compared++
+	}
+	return compared >= perceptualHashMinFrames
+}
+
+// dHashFile computes the 64 bit difference hash of a JPEG image:
+// the image is reduced to 9x8 gray pixels and each bit tells whether
+// a pixel is brighter than its right neighbour. detailed is false for
+// nearly uniform images, whose hash is just noise.
+func dHashFile(path string) (hash uint64, detailed bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		return 0, false, err
+	}
+
+	gray := resizeGray(img, 9, 8)
+	var sum, sumSq float64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 9; x++ {
+			sum += gray[y][x]
+			sumSq += gray[y][x] * gray[y][x]
+		}
+	}
+	mean := sum / 72
+	deviation := math.Sqrt(max(sumSq/72-mean*mean, 0))
+
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if gray[y][x] > gray[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash, deviation >= perceptualHashMinDeviation, nil
+}
+
+// resizeGray averages the image luminance into a w x h matrix.
+func resizeGray(img image.Image, w, h int) [][]float64 {
+	b := img.Bounds()
+	out := make([][]float64, h)
+	for y := 0; y < h; y++ {
+		out[y] = make([]float64, w)
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := b.Min.Y + (y+1)*b.Dy()/h
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := b.Min.X + (x+1)*b.Dx()/w
+
+			var sum float64
+			n := 0
+			// Sample at most ~16x16 pixels per cell to keep it fast on HD frames
+			stepY := max((y1-y0)/16, 1)
+			stepX := max((x1-x0)/16, 1)
+			for py := y0; py < y1; py += stepY {
+				for px := x0; px < x1; px += stepX {
+					r, g, bl, _ := img.At(px, py).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+					n++
+				}
+			}
+			if n > 0 {
+				out[y][x] = sum / float64(n)
+			}
+		}
+	}
+	return out
+}
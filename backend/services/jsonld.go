@@ -0,0 +1,254 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"xgastroteca/models"
+)
+
+// JSONLDContentType is the media type clients send in Accept to get JSON-LD.
+const JSONLDContentType = "application/ld+json"
+
+// JSONLDRecipe is a schema.org Recipe (https://schema.org/Recipe).
+type JSONLDRecipe struct {
+	Context            string           `json:"@context"`
+	Type               string           `json:"@type"`
+	Name               string           `json:"name"`
+	Description        string           `json:"description,omitempty"`
+	Image              []string         `json:"image,omitempty"`
+	Author             *JSONLDPerson    `json:"author,omitempty"`
+	DatePublished      string           `json:"datePublished,omitempty"`
+	InLanguage         string           `json:"inLanguage,omitempty"`
+	IsBasedOn          string           `json:"isBasedOn,omitempty"` // Post the recipe was extracted from
+	TotalTime          string           `json:"totalTime,omitempty"`
+	RecipeYield        string           `json:"recipeYield,omitempty"`
+	Keywords           string           `json:"keywords,omitempty"`
+	SuitableForDiet    []string         `json:"suitableForDiet,omitempty"`
+	Nutrition          *JSONLDNutrition `json:"nutrition,omitempty"`
+	RecipeIngredient   []string         `json:"recipeIngredient"`
+	RecipeInstructions []JSONLDStep     `json:"recipeInstructions"`
+	Video              *JSONLDVideo     `json:"video,omitempty"`
+}
+
+type JSONLDPerson struct {
+	Type string `json:"@type"`
+	Name string `json:"name"`
+}
+
+type JSONLDNutrition struct {
+	Type           string `json:"@type"`
+	ServingSize    string `json:"servingSize"`
+	Calories       string `json:"calories"`
+	ProteinContent string `json:"proteinContent"`
+	Carbohydrates  string `json:"carbohydrateContent"`
+	FatContent     string `json:"fatContent"`
+	FiberContent   string `json:"fiberContent"`
+}
+
+type JSONLDStep struct {
+	Type     string `json:"@type"`
+	Position int    `json:"position"`
+	Text     string `json:"text"`
+	Image    string `json:"image,omitempty"`
+	URL      string `json:"url,omitempty"` // Moment of the video where the step starts
+}
+
+type JSONLDVideo struct {
+	Type         string       `json:"@type"`
+	Name         string       `json:"name"`
+	Description  string       `json:"description"`
+	ThumbnailURL []string     `json:"thumbnailUrl,omitempty"`
+	ContentURL   string       `json:"contentUrl,omitempty"`
+	EmbedURL     string       `json:"embedUrl,omitempty"` // Original post
+	UploadDate   string       `json:"uploadDate,omitempty"`
+	Duration     string       `json:"duration,omitempty"`
+	HasPart      []JSONLDClip `json:"hasPart,omitempty"` // Steps as key moments
+}
+
+type JSONLDClip struct {
+	Type        string `json:"@type"`
+	Name        string `json:"name"`
+	StartOffset int    `json:"startOffset"`
+	EndOffset   int    `json:"endOffset,omitempty"`
+	URL         string `json:"url"`
+}
+
+// RecipeJSONLD converts a recipe (with ingredients, steps and tags loaded)
+// to schema.org JSON-LD. mediaURL turns a store key into an absolute URL.
+func RecipeJSONLD(recipe *models.Recipe, mediaURL func(key string) string) *JSONLDRecipe {
+	ld := &JSONLDRecipe{
+		Context:            "https://schema.org",
+		Type:               "Recipe",
+		Name:               recipe.Title,
+		Description:        recipe.Description,
+		InLanguage:         RecipeLanguage(recipe),
+		IsBasedOn:          recipe.SourceMeta.OriginalURL,
+		TotalTime:          isoMinutes(cookingTimeMinutes(recipe.CookingTime)),
+		RecipeIngredient:   []string{},
+		RecipeInstructions: []JSONLDStep{},
+	}
+
+	// Largest first, as search engines prefer
+	for _, key := range []string{recipe.Thumbnails.Header.JPEG, recipe.ThumbnailPath, recipe.Thumbnails.Card.JPEG} {
+		if key != "" && !containsString(ld.Image, mediaURL(key)) {
+			ld.Image = append(ld.Image, mediaURL(key))
+		}
+	}
+	if recipe.SourceMeta.Uploader != "" {
+		ld.Author = &JSONLDPerson{Type: "Person", Name: recipe.SourceMeta.Uploader}
+	}
+	ld.DatePublished = recipeUploadDate(recipe)
+	if recipe.Servings > 0 {
+		ld.RecipeYield = strconv.Itoa(recipe.Servings)
+	}
+
+	var keywords []string
+	for _, tag := range recipe.Tags {
+		keywords = appendTag(keywords, tag.Name)
+	}
+	ld.Keywords = strings.Join(keywords, ", ")
+
+	if recipe.Dietary.Vegan {
+		ld.SuitableForDiet = append(ld.SuitableForDiet, "https://schema.org/VeganDiet")
+	}
+	if recipe.Dietary.Vegetarian {
+		ld.SuitableForDiet = append(ld.SuitableForDiet, "https://schema.org/VegetarianDiet")
+	}
+
+	if n := recipe.Nutrition; n.Computed {
+		ld.Nutrition = &JSONLDNutrition{
+			Type:           "NutritionInformation",
+			ServingSize:    "1 serving",
+			Calories:       fmt.Sprintf("%.0f calories", n.Calories),
+			ProteinContent: fmt.Sprintf("%.1f g", n.Protein),
+			Carbohydrates:  fmt.Sprintf("%.1f g", n.Carbs),
+			FatContent:     fmt.Sprintf("%.1f g", n.Fat),
+			FiberContent:   fmt.Sprintf("%.1f g", n.Fiber),
+		}
+	}
+
+	for _, ing := range recipe.Ingredients {
+		ld.RecipeIngredient = append(ld.RecipeIngredient, strings.TrimSpace(ing.Quantity+" "+ing.Item))
+	}
+
+	videoURL := ""
+	if recipe.LocalVideoPath != "" {
+		videoURL = mediaURL(recipe.LocalVideoPath)
+	}
+	var clips []JSONLDClip
+	for i, step := range recipe.Steps {
+		s := JSONLDStep{Type: "HowToStep", Position: i + 1, Text: step.Text}
+		if step.ImagePath != "" {
+			s.Image = mediaURL(step.ImagePath)
+		}
+		if videoURL != "" && step.StartSeconds != nil {
+			start := int(*step.StartSeconds)
+			s.URL = fmt.Sprintf("%s#t=%d", videoURL, start)
+			clip := JSONLDClip{Type: "Clip", Name: fmt.Sprintf("Step %d", i+1), StartOffset: start, URL: s.URL}
+			if step.EndSeconds != nil {
+				clip.EndOffset = int(*step.EndSeconds)
+			}
+			clips = append(clips, clip)
+		}
+		ld.RecipeInstructions = append(ld.RecipeInstructions, s)
+	}
+
+	if videoURL != "" || recipe.SourceMeta.OriginalURL != "" {
+		description := recipe.Description
+		if description == "" {
+			description = recipe.Title
+		}
+		ld.Video = &JSONLDVideo{
+			Type:         "VideoObject",
+			Name:         recipe.Title,
+			Description:  description,
+			ThumbnailURL: ld.Image,
+			ContentURL:   videoURL,
+			EmbedURL:     recipe.SourceMeta.OriginalURL,
+			UploadDate:   ld.DatePublished,
+			Duration:     isoSeconds(int(recipe.SourceMeta.Duration)),
+			HasPart:      clips,
+		}
+	}
+	return ld
+}
+
+// recipeUploadDate is the date of the original post (YYYY-MM-DD), or when
+// the recipe was saved if the platform didn't report it.
+func recipeUploadDate(recipe *models.Recipe) string {
+	if d := recipe.SourceMeta.UploadDate; len(d) == 8 {
+		return d[:4] + "-" + d[4:6] + "-" + d[6:]
+	}
+	if recipe.CreatedAt.IsZero() {
+		return ""
+	}
+	return recipe.CreatedAt.Format("2006-01-02")
+}
+
+var (
+	hoursText   = regexp.MustCompile(`(?i)(\d+(?:[.,]\d+)?)\s*(?:h\b|hr|hora|hour|heure)`)
+	minutesText = regexp.MustCompile(`(?i)(\d+)\s*(?:m\b|min|mn\b)`)
+	// Between the times of a list ("1,5 h" is a decimal, not a list)
+	timeSeparators = regexp.MustCompile(`(?i),\s+|;|\+|\s+(?:y|and|e|et|und)\s+`)
+)
+
+// cookingTimeMinutes reads the free text cooking time written by the AI
+// ("45 minutos", "1 h 30 min", "Preparación: 20 min, reposo: 30 min") as
+// minutes. A bare number is taken as minutes, ranges ("20-25 min") count
+// their upper bound and listed times are added up.
+func cookingTimeMinutes(s string) int {
+	if minutes := parseISODuration(s); minutes > 0 {
+		return minutes
+	}
+
+	total := 0
+	for _, part := range timeSeparators.Split(s, -1) {
+		minutes := 0
+		if m := hoursText.FindStringSubmatch(part); m != nil {
+			hours, _ := strconv.ParseFloat(strings.Replace(m[1], ",", ".", 1), 64)
+			minutes += int(hours * 60)
+		}
+		if all := minutesText.FindAllStringSubmatch(part, -1); all != nil {
+			n, _ := strconv.Atoi(all[len(all)-1][1])
+			minutes += n
+		} else if minutes == 0 {
+			if numbers := firstNumber.FindAllString(part, -1); len(numbers) > 0 {
+				minutes, _ = strconv.Atoi(numbers[len(numbers)-1])
+			}
+		}
+		total += minutes
+	}
+	return total
+}
+
+// isoMinutes formats minutes as an ISO 8601 duration (PT1H30M).
+func isoMinutes(minutes int) string {
+	if minutes <= 0 {
+		return ""
+	}
+	d := "PT"
+	if minutes >= 60 {
+		d += fmt.Sprintf("%dH", minutes/60)
+	}
+	if minutes%60 > 0 {
+		d += fmt.Sprintf("%dM", minutes%60)
+	}
+	return d
+}
+
+// isoSeconds formats seconds as an ISO 8601 duration (PT1M5S).
+func isoSeconds(seconds int) string {
+	if seconds <= 0 {
+		return ""
+	}
+	d := isoMinutes(seconds / 60)
+	if d == "" {
+		d = "PT"
+	}
+	if seconds%60 > 0 {
+		d += fmt.Sprintf("%dS", seconds%60)
+	}
+	return d
+}
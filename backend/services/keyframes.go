@@ -0,0 +1,241 @@
+package services
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"xgastroteca/models"
+)
+
+const (
+	sceneThreshold = "0.3" // ffmpeg scene change score (0-1)
+	maxKeyframes   = 12
+)
+
+// ProbeDuration returns the duration of a media file in seconds using ffprobe.
+func ProbeDuration(videoPath string) (float64, error) {
+	out, err := exec.Command("ffprobe",
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		videoPath,
+	).Output()
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe failed: %v", err)
+	}
+
+	duration, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q: %v", out, err)
+	}
+	return duration, nil
+}
+
+// ExtractFrameAt saves a single JPEG frame of the video at the given second.
+func ExtractFrameAt(videoPath string, seconds float64, outPath string) error {
+	cmd := exec.Command("ffmpeg",
+		"-y",
+		"-ss", strconv.FormatFloat(seconds, 'f', 2, 64),
+		"-i", videoPath,
+		"-frames:v", "1",
+		"-q:v", "2",
+		outPath,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to extract frame: %v (%s)", err, lastLine(out))
+	}
+	return nil
+}
+
+// ExtractSceneKeyframes saves the frames where ffmpeg detects a scene change.
+// Files are named <prefix>_kf_NN.jpg and their paths are returned.
+func ExtractSceneKeyframes(videoPath string, prefix string) ([]string, error) {
+	pattern := prefix + "_kf_%02d.jpg"
+	cmd := exec.Command("ffmpeg",
+		"-y",
+		"-i", videoPath,
+		"-vf", "select='gt(scene,"+sceneThreshold+")'",
+		"-vsync", "vfr",
+		"-frames:v", strconv.Itoa(maxKeyframes),
+		"-q:v", "2",
+		pattern,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to extract keyframes: %v (%s)", err, lastLine(out))
+	}
+
+	return filepath.Glob(prefix + "_kf_*.jpg")
+}
+
+// SelectBestFrame returns the sharpest, well exposed frame of the list.
+func SelectBestFrame(paths []string) (string, error) {
+	best := ""
+	bestScore := -1.0
+	for _, p := range paths {
+		score, err := frameScore(p)
+		if err != nil {
+			log.Printf("Skipping frame %s: %v", p, err)
+			continue
+		}
+		if score > bestScore {
+			best, bestScore = p, score
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no usable frame")
+	}
+	return best, nil
+}
+
+// frameScore rates a frame by the variance of its Laplacian (sharpness),
+// penalizing frames that are too dark or too bright (fades, flashes).
+func frameScore(path string) (float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		return 0, err
+	}
+
+	gray := downsampleGray(img, 160)
+	h := len(gray)
+	if h < 3 || len(gray[0]) < 3 {
+		return 0, fmt.Errorf("frame too small")
+	}
+	w := len(gray[0])
+
+	var sum, sumSq, lum float64
+	n := 0
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			lap := 4*gray[y][x] - gray[y-1][x] - gray[y+1][x] - gray[y][x-1] - gray[y][x+1]
+			sum += lap
+			sumSq += lap * lap
+			lum += gray[y][x]
+			n++
+		}
+	}
+	mean := sum / float64(n)
+	variance := sumSq/float64(n) - mean*mean
+
+	avgLum := lum / float64(n)
+	if avgLum < 40 || avgLum > 215 {
+		variance *= 0.2
+	}
+	return variance, nil
+}
+
+// downsampleGray converts an image to a luminance matrix about maxWidth pixels wide.
+func downsampleGray(img image.Image, maxWidth int) [][]float64 {
+	b := img.Bounds()
+	step := b.Dx() / maxWidth
+	if step < 1 {
+		step = 1
+	}
+
+	var rows [][]float64
+	for y := b.Min.Y; y < b.Max.Y; y += step {
+		var row []float64
+		for x := b.Min.X; x < b.Max.X; x += step {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			row = append(row, (0.299*float64(r)+0.587*float64(g)+0.114*float64(bl))/257)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// GenerateRecipeImages picks a cover image from the video keyframes and
+// saves a still for every step. fullVideoPath is the file on disk; the
+// resulting paths are stored relative to the web root ("videos/...").
+// For videos with several recipes only the time range of the recipe is used.
+// Failures are logged and leave the current thumbnail in place.
+func GenerateRecipeImages(recipe *models.Recipe, fullVideoPath string) {
+	dir := filepath.Dir(fullVideoPath)
+	prefix := strings.TrimSuffix(fullVideoPath, filepath.Ext(fullVideoPath))
+	if recipe.Part > 0 {
+		prefix = fmt.Sprintf("%s_p%d", prefix, recipe.Part)
+	}
+
+	duration, err := ProbeDuration(fullVideoPath)
+	if err != nil {
+		log.Printf("Skipping keyframe extraction: %v", err)
+		return
+	}
+
+	// Part of the video showing this recipe
+	from, to := 0.0, duration
+	ranged := recipe.StartSeconds != nil && recipe.EndSeconds != nil && *recipe.StartSeconds < duration
+	if ranged {
+		from, to = *recipe.StartSeconds, min(*recipe.EndSeconds, duration)
+	}
+
+	// 1. Cover: sharpest scene change, or evenly spaced frames if there are none.
+	// Scene detection covers the whole video, so it's skipped for a time range.
+	var keyframes []string
+	if !ranged {
+		keyframes, err = ExtractSceneKeyframes(fullVideoPath, prefix)
+		if err != nil {
+			log.Printf("Scene detection failed: %v", err)
+		}
+	}
+	if len(keyframes) == 0 {
+		for i, pct := range []float64{0.25, 0.5, 0.75} {
+			p := fmt.Sprintf("%s_kf_%02d.jpg", prefix, i+1)
+			if err := ExtractFrameAt(fullVideoPath, from+(to-from)*pct, p); err == nil {
+				keyframes = append(keyframes, p)
+			}
+		}
+	}
+
+	if best, err := SelectBestFrame(keyframes); err == nil {
+		coverPath := prefix + "_cover.jpg"
+		if err := os.Rename(best, coverPath); err == nil {
+			recipe.ThumbnailPath = "videos/" + filepath.Base(coverPath)
+		}
+	} else {
+		log.Printf("Could not select cover frame: %v", err)
+	}
+
+	// Keyframe candidates are temporary
+	for _, k := range keyframes {
+		os.Remove(k)
+	}
+
+	// 2. One still per step
+	for i := range recipe.Steps {
+		step := &recipe.Steps[i]
+
+		var at float64
+		switch {
+		case step.StartSeconds != nil && step.EndSeconds != nil:
+			at = (*step.StartSeconds + *step.EndSeconds) / 2
+		case step.StartSeconds != nil:
+			at = *step.StartSeconds + 1
+		default:
+			// No timestamp: spread the steps along the recipe part of the video
+			at = from + (to-from)*(float64(i)+0.5)/float64(len(recipe.Steps))
+		}
+		// Seeking to the very end returns no frame
+		if at > duration-0.5 {
+			at = max(duration-0.5, 0)
+		}
+
+		stepPath := filepath.Join(dir, fmt.Sprintf("%s_step_%02d.jpg", filepath.Base(prefix), i+1))
+		if err := ExtractFrameAt(fullVideoPath, at, stepPath); err != nil {
+			log.Printf("Could not extract image for step %d: %v", i+1, err)
+			continue
+		}
+		step.ImagePath = "videos/" + filepath.Base(stepPath)
+	}
+}
@@ -0,0 +1,82 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"xgastroteca/database"
+	"xgastroteca/models"
+	"xgastroteca/utils"
+)
+
+const maxRedirects = 5
+
+// redirectClient follows a bounded number of redirects within a short timeout,
+// only to public addresses like webClient.
+var redirectClient = &http.Client{
+	Timeout:   10 * time.Second,
+	Transport: publicTransport(),
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		return nil
+	},
+}
+
+// ResolveShortLink follows the redirects of a short link (vm.tiktok.com,
+// fb.watch, bit.ly...) and returns the final URL.
+func ResolveShortLink(rawURL string) (string, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
+	}
+
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL: %v", err)
+	}
+	req.Header.Set("User-Agent", webUserAgent)
+
+	resp, err := redirectClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve link: %v", err)
+	}
+	resp.Body.Close() // Only the final URL matters
+
+	return resp.Request.URL.String(), nil
+}
+
+// NormalizeURL resolves short links when needed and returns the source,
+// external ID and canonical URL of a shared link.
+func NormalizeURL(rawURL string) (source, externalID, canonical string, err error) {
+	if utils.NeedsResolution(rawURL) {
+		resolved, err := ResolveShortLink(rawURL)
+		if err != nil {
+			log.Printf("Could not resolve short link %s: %v", rawURL, err)
+		} else {
+			log.Printf("Short link %s resolved to %s", rawURL, resolved)
+			rawURL = resolved
+		}
+	}
+	return utils.CanonicalizeURL(rawURL)
+}
+
+// CanonicalizePendingRecipes stores the canonical URL of recipes created before it was tracked.
+func CanonicalizePendingRecipes() {
+	var recipes []models.Recipe
+	database.DB.Where("canonical_url = '' OR canonical_url IS NULL").Find(&recipes)
+	for _, r := range recipes {
+		canonical := ""
+		if src := utils.FindSource(r.Source); src != nil {
+			canonical = src.CanonicalURL(r.ExternalID)
+		} else if r.Source == models.SourceWeb && r.SourceMeta.OriginalURL != "" {
+			canonical, _ = utils.CanonicalWebURL(r.SourceMeta.OriginalURL)
+		}
+		if canonical != "" {
+			database.DB.Model(&models.Recipe{}).Where("id = ?", r.ID).Update("canonical_url", canonical)
+		}
+	}
+}
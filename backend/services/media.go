@@ -0,0 +1,167 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"xgastroteca/database"
+	"xgastroteca/models"
+	"xgastroteca/storage"
+)
+
+// recipeMediaKeys lists the stored files of a recipe (HLS playlists are
+// returned as is, their segments are handled by prefix).
+func recipeMediaKeys(recipe *models.Recipe) []string {
+	var keys []string
+	for _, key := range []string{recipe.LocalVideoPath, recipe.OriginalVideoPath, recipe.ThumbnailPath} {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	keys = append(keys, thumbnailVariantKeys(recipe)...)
+	for _, step := range recipe.Steps {
+		if step.ImagePath != "" {
+			keys = append(keys, step.ImagePath)
+		}
+	}
+	return keys
+}
+
+// thumbnailVariantKeys lists the resized thumbnails of a recipe.
+func thumbnailVariantKeys(recipe *models.Recipe) []string {
+	var keys []string
+	for _, v := range []models.ThumbnailVariant{recipe.Thumbnails.Card, recipe.Thumbnails.Header} {
+		for _, key := range []string{v.JPEG, v.WebP} {
+			if key != "" {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// storeIsWorkDir reports whether the media store is the work directory itself.
+func storeIsWorkDir() bool {
+	p, ok := storage.LocalPath(storage.Media, "videos")
+	return ok && storage.SameFile(p, storage.WorkPath("videos"))
+}
+
+// publishWorkFiles copies files of the work directory to the media store and
+// removes the local copies when the store is elsewhere.
+func publishWorkFiles(keys []string) error {
+	ctx := context.Background()
+	for _, key := range keys {
+		if err := storage.PutFile(ctx, storage.Media, key, storage.WorkPath(key)); err != nil {
+			return fmt.Errorf("failed to store %s: %v", key, err)
+		}
+	}
+	for _, key := range keys {
+		// The only copy when the store keeps its files in the work directory
+		if p, ok := storage.LocalPath(storage.Media, key); ok && storage.SameFile(p, storage.WorkPath(key)) {
+			continue
+		}
+		os.Remove(storage.WorkPath(key))
+	}
+	return nil
+}
+
+// PublishRecipeMedia copies the files written by the pipeline in the work
+// directory to the media store, and removes the local copies when the store
+// is elsewhere. With the local store the files are already in place.
+func PublishRecipeMedia(recipes []*models.Recipe) error {
+	seen := make(map[string]bool)
+	var keys []string
+	add := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	for _, recipe := range recipes {
+		for _, key := range recipeMediaKeys(recipe) {
+			add(key)
+		}
+
+		// Playlist and segments of the HLS directory
+		if recipe.StreamPath != "" {
+			dir := path.Dir(recipe.StreamPath)
+			entries, err := os.ReadDir(storage.WorkPath(dir))
+			if err != nil {
+				return fmt.Errorf("failed to read HLS directory: %v", err)
+			}
+			for _, e := range entries {
+				add(dir + "/" + e.Name())
+			}
+		}
+	}
+
+	if err := publishWorkFiles(keys); err != nil {
+		return err
+	}
+	if storeIsWorkDir() {
+		return nil
+	}
+	for _, recipe := range recipes {
+		if recipe.StreamPath != "" {
+			os.Remove(filepath.Dir(storage.WorkPath(recipe.StreamPath)))
+		}
+	}
+	log.Printf("Published %d media files", len(keys))
+	return nil
+}
+
+// DeleteRecipeMedia removes the files of a recipe from the store, except the
+// ones still used by another recipe (variants and parts share them).
+func DeleteRecipeMedia(recipe *models.Recipe) {
+	ctx := context.Background()
+
+	for _, key := range recipeMediaKeys(recipe) {
+		if MediaReferenced(key, recipe.ID) {
+			continue
+		}
+		if err := storage.Media.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Failed to delete %s: %v", key, err)
+		}
+	}
+
+	if recipe.StreamPath != "" && !MediaReferenced(recipe.StreamPath, recipe.ID) {
+		if err := storage.DeletePrefix(ctx, storage.Media, path.Dir(recipe.StreamPath)+"/"); err != nil {
+			log.Printf("Failed to delete HLS segments: %v", err)
+		}
+	}
+}
+
+// legacyMediaKey turns a path stored by the first versions ("data/videos/x.mp4")
+// into a store key ("videos/x.mp4").
+func legacyMediaKey(p string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(p, "./"), "data/")
+}
+
+// NormalizeMediaPaths rewrites the legacy media paths of recipes and steps as store keys.
+func NormalizeMediaPaths() {
+	var recipes []models.Recipe
+	database.DB.Unscoped().Where("local_video_path LIKE ? OR local_video_path LIKE ? OR thumbnail_path LIKE ? OR thumbnail_path LIKE ?",
+		"data/%", "./data/%", "data/%", "./data/%").Find(&recipes)
+	for _, r := range recipes {
+		database.DB.Unscoped().Model(&r).UpdateColumns(map[string]interface{}{
+			"local_video_path": legacyMediaKey(r.LocalVideoPath),
+			"thumbnail_path":   legacyMediaKey(r.ThumbnailPath),
+		})
+	}
+
+	var steps []models.Step
+	database.DB.Where("image_path LIKE ? OR image_path LIKE ?", "data/%", "./data/%").Find(&steps)
+	for _, s := range steps {
+		database.DB.Model(&s).UpdateColumn("image_path", legacyMediaKey(s.ImagePath))
+	}
+
+	if len(recipes)+len(steps) > 0 {
+		log.Printf("Normalized media paths of %d recipes and %d steps", len(recipes), len(steps))
+	}
+}
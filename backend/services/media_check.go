@@ -0,0 +1,291 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"xgastroteca/database"
+	"xgastroteca/models"
+	"xgastroteca/storage"
+)
+
+// What the media check does with orphaned files (MEDIA_GC_ACTION)
+const (
+	MediaActionReport     = "report" // Only list them
+	MediaActionQuarantine = "quarantine"
+	MediaActionDelete     = "delete"
+)
+
+const (
+	quarantinePrefix   = "quarantine/"
+	defaultOrphanGrace = 24 * time.Hour
+	minOrphanGrace     = time.Hour // Longer than any analysis, so its files are never taken as orphans
+)
+
+// MediaFile is a stored file not used by any recipe.
+type MediaFile struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Location string    `json:"location"` // "store", or "work" for leftovers in the local work directory
+}
+
+// MissingMedia is a file referenced by a recipe that doesn't exist.
+type MissingMedia struct {
+	RecipeID uint   `json:"recipe_id"`
+	Title    string `json:"title"`
+	Field    string `json:"field"` // video, original_video, thumbnail, thumbnail_variant, stream, step_image
+	Path     string `json:"path"`
+}
+
+// MediaReport is the result of a consistency check of the media files.
+type MediaReport struct {
+	CheckedAt       time.Time      `json:"checked_at"`
+	Action          string         `json:"action"`
+	Files           int            `json:"files"`
+	TotalBytes      int64          `json:"total_bytes"`
+	ReferencedBytes int64          `json:"referenced_bytes"`
+	OrphanBytes     int64          `json:"orphan_bytes"`
+	QuarantineBytes int64          `json:"quarantine_bytes"`
+	Orphans         []MediaFile    `json:"orphans"`
+	Missing         []MissingMedia `json:"missing"`
+	Removed         int            `json:"removed"` // Orphans deleted or quarantined
+	Errors          []string       `json:"errors,omitempty"`
+}
+
+// mediaRef is a file a recipe points to.
+type mediaRef struct {
+	recipe *models.Recipe
+	field  string
+	key    string
+}
+
+// recipeMediaRefs lists the files used by every recipe. Deleted rows are
+// included, their files go away with the hard delete.
+func recipeMediaRefs() ([]mediaRef, error) {
+	var recipes []models.Recipe
+	if err := database.DB.Unscoped().Preload("Steps").Find(&recipes).Error; err != nil {
+		return nil, err
+	}
+
+	var refs []mediaRef
+	for i := range recipes {
+		r := &recipes[i]
+		for field, key := range map[string]string{
+			"video":          r.LocalVideoPath,
+			"original_video": r.OriginalVideoPath,
+			"thumbnail":      r.ThumbnailPath,
+			"stream":         r.StreamPath,
+		} {
+			if key != "" {
+				refs = append(refs, mediaRef{recipe: r, field: field, key: key})
+			}
+		}
+		for _, key := range thumbnailVariantKeys(r) {
+			refs = append(refs, mediaRef{recipe: r, field: "thumbnail_variant", key: key})
+		}
+		for _, step := range r.Steps {
+			if step.ImagePath != "" {
+				refs = append(refs, mediaRef{recipe: r, field: "step_image", key: step.ImagePath})
+			}
+		}
+	}
+	return refs, nil
+}
+
+// queuedUploadKeys returns the uploaded videos still waiting in the queue.
+func queuedUploadKeys() map[string]bool {
+	var jobs []models.ProcessingJob
+	database.DB.Where("status IN ?", []models.JobStatus{models.JobStatusPending, models.JobStatusProcessing}).Find(&jobs)
+
+	keys := make(map[string]bool)
+	for _, job := range jobs {
+		if IsUploadJob(job.URL) {
+			keys["videos/"+filepath.Base(strings.TrimPrefix(job.URL, uploadJobScheme))] = true
+		}
+	}
+	return keys
+}
+
+// orphanGracePeriod is how old an unreferenced file must be to count as an
+// orphan, so videos being analyzed right now are left alone (MEDIA_GC_GRACE_HOURS,
+// at least one hour).
+func orphanGracePeriod() time.Duration {
+	hours, err := strconv.Atoi(os.Getenv("MEDIA_GC_GRACE_HOURS"))
+	if err != nil || hours < 0 {
+		return defaultOrphanGrace
+	}
+	if grace := time.Duration(hours) * time.Hour; grace >= minOrphanGrace {
+		return grace
+	}
+	log.Printf("MEDIA_GC_GRACE_HOURS=%d is too short, using %s", hours, minOrphanGrace)
+	return minOrphanGrace
+}
+
+// CheckMedia compares the media files with the recipes: files nobody uses
+// (failed analyses, removed variants...) and recipes pointing to missing
+// files. Orphans are deleted or moved to quarantine/ depending on action.
+func CheckMedia(action string) (*MediaReport, error) {
+	ctx := context.Background()
+	report := &MediaReport{CheckedAt: time.Now(), Action: action}
+	cutoff := time.Now().Add(-orphanGracePeriod())
+
+	refs, err := recipeMediaRefs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load recipes: %v", err)
+	}
+	referenced := queuedUploadKeys()
+	var streamDirs []string
+	for _, ref := range refs {
+		referenced[ref.key] = true
+		if ref.field == "stream" {
+			streamDirs = append(streamDirs, path.Dir(ref.key)+"/")
+		}
+	}
+	isReferenced := func(key string) bool {
+		if referenced[key] {
+			return true
+		}
+		for _, dir := range streamDirs {
+			if strings.HasPrefix(key, dir) {
+				return true
+			}
+		}
+		return false
+	}
+
+	objects, err := storage.Media.List(ctx, "videos/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list media: %v", err)
+	}
+
+	stored := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		stored[obj.Key] = true
+		report.Files++
+		report.TotalBytes += obj.Size
+		switch {
+		case isReferenced(obj.Key):
+			report.ReferencedBytes += obj.Size
+		case obj.ModTime.Before(cutoff):
+			report.Orphans = append(report.Orphans, MediaFile{Key: obj.Key, Size: obj.Size, ModTime: obj.ModTime, Location: "store"})
+			report.OrphanBytes += obj.Size
+		}
+	}
+
+	if quarantined, err := storage.Media.List(ctx, quarantinePrefix); err == nil {
+		for _, obj := range quarantined {
+			report.QuarantineBytes += obj.Size
+		}
+	}
+
+	// With a remote store, whatever stays in the work directory was never published
+	if !storeIsWorkDir() {
+		for _, f := range workLeftovers(cutoff, referenced) {
+			report.Orphans = append(report.Orphans, f)
+			report.OrphanBytes += f.Size
+		}
+	}
+
+	for _, ref := range refs {
+		if !stored[ref.key] {
+			report.Missing = append(report.Missing, MissingMedia{RecipeID: ref.recipe.ID, Title: ref.recipe.Title, Field: ref.field, Path: ref.key})
+		}
+	}
+
+	if action == MediaActionDelete || action == MediaActionQuarantine {
+		for _, f := range report.Orphans {
+			if err := removeOrphan(ctx, f, action); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", f.Key, err))
+				continue
+			}
+			report.Removed++
+		}
+	}
+
+	log.Printf("Media check: %d files (%d MB), %d orphans (%d MB), %d missing, %d removed",
+		report.Files, report.TotalBytes>>20, len(report.Orphans), report.OrphanBytes>>20, len(report.Missing), report.Removed)
+	return report, nil
+}
+
+// workLeftovers lists the old files of the local work directory.
+func workLeftovers(cutoff time.Time, referenced map[string]bool) []MediaFile {
+	var files []MediaFile
+	root := storage.WorkPath("videos")
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			return nil
+		}
+		rel, _ := filepath.Rel(storage.WorkDir, p)
+		key := filepath.ToSlash(rel)
+		if !referenced[key] {
+			files = append(files, MediaFile{Key: key, Size: info.Size(), ModTime: info.ModTime(), Location: "work"})
+		}
+		return nil
+	})
+	return files
+}
+
+// removeOrphan deletes an orphan, or moves it to quarantine/<key> in the store.
+func removeOrphan(ctx context.Context, f MediaFile, action string) error {
+	if f.Location == "work" {
+		if action == MediaActionQuarantine {
+			if err := storage.PutFile(ctx, storage.Media, quarantinePrefix+f.Key, storage.WorkPath(f.Key)); err != nil {
+				return err
+			}
+		}
+		return os.Remove(storage.WorkPath(f.Key))
+	}
+
+	if action == MediaActionQuarantine {
+		body, err := storage.Media.Get(ctx, f.Key)
+		if err != nil {
+			return err
+		}
+		err = storage.Media.Put(ctx, quarantinePrefix+f.Key, body, f.Size, storage.ContentType(f.Key))
+		body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return storage.Media.Delete(ctx, f.Key)
+}
+
+// StartMediaChecker runs the media check periodically (MEDIA_GC_INTERVAL_HOURS,
+// 0 disables it) applying MEDIA_GC_ACTION to the orphans (report by default).
+func StartMediaChecker() {
+	hours := 24
+	if h, err := strconv.Atoi(os.Getenv("MEDIA_GC_INTERVAL_HOURS")); err == nil && h >= 0 {
+		hours = h
+	}
+	if hours == 0 {
+		return
+	}
+
+	action := os.Getenv("MEDIA_GC_ACTION")
+	if action != MediaActionQuarantine && action != MediaActionDelete {
+		action = MediaActionReport
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(hours) * time.Hour)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if _, err := CheckMedia(action); err != nil {
+				log.Printf("Media check failed: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"xgastroteca/models"
+	"xgastroteca/utils"
+)
+
+// ytDlpInfo is the subset of the yt-dlp info JSON we care about.
+type ytDlpInfo struct {
+	Description string   `json:"description"`
+	Title       string   `json:"title"`
+	Uploader    string   `json:"uploader"`
+	UploaderID  string   `json:"uploader_id"`
+	Channel     string   `json:"channel"`
+	UploadDate  string   `json:"upload_date"`
+	Duration    float64  `json:"duration"`
+	WebpageURL  string   `json:"webpage_url"`
+	OriginalURL string   `json:"original_url"`
+	Tags        []string `json:"tags"`
+}
+
+// LoadSourceMetadata parses the .info.json file written by yt-dlp.
+func LoadSourceMetadata(infoPath string) (*models.SourceMetadata, error) {
+	data, err := os.ReadFile(infoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read info json: %v", err)
+	}
+
+	var info ytDlpInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("failed to parse info json: %v", err)
+	}
+
+	caption := info.Description
+	if caption == "" {
+		// Instagram sometimes only fills the title with the caption
+		caption = info.Title
+	}
+
+	uploader := info.Uploader
+	if uploader == "" {
+		uploader = info.Channel
+	}
+	if uploader == "" {
+		uploader = info.UploaderID
+	}
+
+	originalURL := info.WebpageURL
+	if originalURL == "" {
+		originalURL = info.OriginalURL
+	}
+
+	// Hashtags from the caption first, then the platform tags
+	hashtags := utils.ExtractHashtags(caption)
+	seen := make(map[string]bool)
+	for _, h := range hashtags {
+		seen[utils.NormalizeString(h)] = true
+	}
+	for _, t := range info.Tags {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "#")
+		if t == "" || seen[utils.NormalizeString(t)] {
+			continue
+		}
+		seen[utils.NormalizeString(t)] = true
+		hashtags = append(hashtags, t)
+	}
+
+	return &models.SourceMetadata{
+		Caption:     strings.TrimSpace(caption),
+		Uploader:    uploader,
+		UploadDate:  info.UploadDate,
+		Duration:    info.Duration,
+		OriginalURL: originalURL,
+		Hashtags:    strings.Join(hashtags, ","),
+	}, nil
+}
+
+// SuggestedTags returns the source hashtags that are not yet tags of the recipe.
+func SuggestedTags(recipe *models.Recipe) []string {
+	existing := make(map[string]bool)
+	for _, t := range recipe.Tags {
+		existing[utils.NormalizeString(t.Name)] = true
+	}
+
+	suggestions := []string{}
+	if recipe.SourceMeta.Hashtags == "" {
+		return suggestions
+	}
+	for _, h := range strings.Split(recipe.SourceMeta.Hashtags, ",") {
+		if !existing[utils.NormalizeString(h)] {
+			suggestions = append(suggestions, h)
+		}
+	}
+	return suggestions
+}
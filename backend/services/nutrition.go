@@ -0,0 +1,323 @@
+package services
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"xgastroteca/database"
+	"xgastroteca/models"
+	"xgastroteca/utils"
+)
+
+// Offline nutrient table: values per 100 g (based on USDA/BEDCA data).
+//
+//go:embed nutrients.csv
+var nutrientsCSV string
+
+// Food is an entry of the nutrient table.
+type Food struct {
+	Key      string   `json:"key"`
+	Names    []string `json:"names"`
+	Calories float64  `json:"calories"` // per 100 g
+	Protein  float64  `json:"protein"`
+	Carbs    float64  `json:"carbs"`
+	Fat      float64  `json:"fat"`
+	Fiber    float64  `json:"fiber"`
+	UnitG    float64  `json:"unit_grams"` // Weight of one piece (egg, onion...), 0 if not countable
+}
+
+// Grams per unit. Volumes assume a density of 1 g/ml.
+var unitGrams = map[string]float64{
+	"g": 1, "gr": 1, "grs": 1, "gramo": 1, "gramos": 1, "gram": 1, "grams": 1,
+	"kg": 1000, "kilo": 1000, "kilos": 1000,
+	"mg": 0.001,
+	"ml": 1, "mililitro": 1, "mililitros": 1,
+	"cl": 10, "dl": 100,
+	"l": 1000, "litro": 1000, "litros": 1000, "liter": 1000, "liters": 1000,
+	"cucharada": 15, "cucharadas": 15, "cda": 15, "cdas": 15, "tbsp": 15, "tablespoon": 15, "tablespoons": 15,
+	"cucharadita": 5, "cucharaditas": 5, "cdta": 5, "cdtas": 5, "cdita": 5, "tsp": 5, "teaspoon": 5, "teaspoons": 5,
+	"taza": 240, "tazas": 240, "cup": 240, "cups": 240,
+	"vaso": 200, "vasos": 200,
+	"pizca": 0.5, "pizcas": 0.5, "pinch": 0.5,
+	"chorro": 10, "chorrito": 5,
+	"oz": 28.35, "lb": 453.6,
+}
+
+// Quantities that mean "a negligible amount"
+var negligibleQuantities = []string{"al gusto", "a gusto", "to taste", "c/s", "cantidad suficiente", "opcional"}
+
+var nonLetters = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+
+var (
+	foodsOnce sync.Once
+	foods     []Food
+	foodsByID map[string]*Food
+)
+
+// Foods returns the nutrient table.
+func Foods() []Food {
+	foodsOnce.Do(loadFoods)
+	return foods
+}
+
+// FindFood returns a table entry by key.
+func FindFood(key string) *Food {
+	foodsOnce.Do(loadFoods)
+	return foodsByID[key]
+}
+
+func loadFoods() {
+	foodsByID = make(map[string]*Food)
+
+	records, err := csv.NewReader(strings.NewReader(nutrientsCSV)).ReadAll()
+	if err != nil {
+		log.Printf("Failed to load nutrient table: %v", err)
+		return
+	}
+
+	for _, rec := range records[1:] {
+		values := make([]float64, 6)
+		for i := range values {
+			values[i], _ = strconv.ParseFloat(rec[2+i], 64)
+		}
+		var names []string
+		for _, n := range strings.Split(rec[1], "|") {
+			names = append(names, normalizeFoodText(n))
+		}
+		foods = append(foods, Food{
+			Key:      rec[0],
+			Names:    names,
+			Calories: values[0],
+			Protein:  values[1],
+			Carbs:    values[2],
+			Fat:      values[3],
+			Fiber:    values[4],
+			UnitG:    values[5],
+		})
+	}
+	for i := range foods {
+		foodsByID[foods[i].Key] = &foods[i]
+	}
+}
+
+// normalizeFoodText lowercases, removes accents and punctuation and pads
+// with spaces so names can be matched as whole words.
+func normalizeFoodText(s string) string {
+	return " " + strings.TrimSpace(nonLetters.ReplaceAllString(utils.NormalizeString(s), " ")) + " "
+}
+
+// MatchFood finds the table entry for an ingredient name.
+// The longest matching name wins ("harina de maiz" over "harina").
+func MatchFood(item string) *Food {
+	text := normalizeFoodText(item)
+
+	var best *Food
+	bestLen := 0
+	for i := range Foods() {
+		for _, name := range foods[i].Names {
+			if len(name) > bestLen && strings.Contains(text, name) {
+				best, bestLen = &foods[i], len(name)
+			}
+		}
+	}
+	return best
+}
+
+// EstimateGrams converts an ingredient quantity to grams.
+func EstimateGrams(ing models.Ingredient, food *Food) (float64, bool) {
+	quantity := utils.NormalizeString(strings.TrimSpace(ing.Quantity))
+	for _, n := range negligibleQuantities {
+		if strings.Contains(quantity, n) {
+			return 0, true
+		}
+	}
+
+	amount, unit, ok := utils.ParseQuantity(ing.Quantity)
+	if !ok && quantity == "" {
+		// Quantity written in the item itself ("2 huevos")
+		amount, _, ok = utils.ParseQuantity(ing.Item)
+		unit = ""
+	}
+	if !ok {
+		if g, found := unitGrams[firstWord(unit)]; found {
+			return g, true // "pizca" without a number
+		}
+		return 0, false
+	}
+
+	if g, found := unitGrams[firstWord(unit)]; found {
+		return amount * g, true
+	}
+
+	// No known unit: count of pieces ("2", "2 unidades", "3 dientes")
+	if food != nil && food.UnitG > 0 {
+		return amount * food.UnitG, true
+	}
+	return 0, false
+}
+
+func firstWord(s string) string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.Trim(fields[0], ".")
+}
+
+// IngredientNutrition is the nutrition breakdown of one ingredient.
+type IngredientNutrition struct {
+	IngredientID uint     `json:"ingredient_id"`
+	Item         string   `json:"item"`
+	Quantity     string   `json:"quantity"`
+	Food         string   `json:"food"`
+	Grams        *float64 `json:"grams"`
+	Manual       bool     `json:"manual"`
+	Status       string   `json:"status"` // matched, no_match, unknown_quantity
+	Calories     float64  `json:"calories"`
+	Protein      float64  `json:"protein"`
+	Carbs        float64  `json:"carbs"`
+	Fat          float64  `json:"fat"`
+	Fiber        float64  `json:"fiber"`
+}
+
+// ComputeNutrition matches every ingredient against the nutrient table
+// (keeping manual matches), sums the values and stores the per serving
+// result in recipe.Nutrition. Recipes without servings count as one.
+func ComputeNutrition(recipe *models.Recipe) []IngredientNutrition {
+	var total models.NutritionInfo
+	breakdown := []IngredientNutrition{}
+
+	for i := range recipe.Ingredients {
+		ing := &recipe.Ingredients[i]
+
+		if !ing.MatchManual {
+			ing.FoodMatch = ""
+			ing.Grams = nil
+			if food := MatchFood(ing.Item); food != nil {
+				ing.FoodMatch = food.Key
+				if g, ok := EstimateGrams(*ing, food); ok {
+					ing.Grams = &g
+				}
+			}
+		}
+
+		item := IngredientNutrition{
+			IngredientID: ing.ID,
+			Item:         ing.Item,
+			Quantity:     ing.Quantity,
+			Food:         ing.FoodMatch,
+			Grams:        ing.Grams,
+			Manual:       ing.MatchManual,
+		}
+
+		food := FindFood(ing.FoodMatch)
+		switch {
+		case food == nil:
+			item.Status = "no_match"
+			total.Unmatched++
+		case ing.Grams == nil && food.Calories > 0:
+			item.Status = "unknown_quantity"
+			total.Unmatched++
+		default:
+			item.Status = "matched"
+			if ing.Grams == nil {
+				// Zero calorie food (salt, water): the quantity doesn't matter
+				break
+			}
+			factor := *ing.Grams / 100
+			item.Calories = food.Calories * factor
+			item.Protein = food.Protein * factor
+			item.Carbs = food.Carbs * factor
+			item.Fat = food.Fat * factor
+			item.Fiber = food.Fiber * factor
+
+			total.Calories += item.Calories
+			total.Protein += item.Protein
+			total.Carbs += item.Carbs
+			total.Fat += item.Fat
+			total.Fiber += item.Fiber
+		}
+		breakdown = append(breakdown, item)
+	}
+
+	servings := float64(max(recipe.Servings, 1))
+	recipe.Nutrition = models.NutritionInfo{
+		Calories:  round1(total.Calories / servings),
+		Protein:   round1(total.Protein / servings),
+		Carbs:     round1(total.Carbs / servings),
+		Fat:       round1(total.Fat / servings),
+		Fiber:     round1(total.Fiber / servings),
+		Unmatched: total.Unmatched,
+		Computed:  true,
+	}
+	return breakdown
+}
+
+func round1(v float64) float64 {
+	return float64(int64(v*10+0.5)) / 10
+}
+
+// SaveNutrition persists the nutrition of a recipe and its ingredient matches.
+func SaveNutrition(recipe *models.Recipe) error {
+	for _, ing := range recipe.Ingredients {
+		err := database.DB.Model(&models.Ingredient{}).Where("id = ?", ing.ID).Updates(map[string]interface{}{
+			"food_match":   ing.FoodMatch,
+			"grams":        ing.Grams,
+			"match_manual": ing.MatchManual,
+		}).Error
+		if err != nil {
+			return fmt.Errorf("failed to save ingredient %d: %v", ing.ID, err)
+		}
+	}
+
+	n := recipe.Nutrition
+	return database.DB.Model(&models.Recipe{}).Where("id = ?", recipe.ID).Updates(map[string]interface{}{
+		"servings":            recipe.Servings,
+		"nutrition_calories":  n.Calories,
+		"nutrition_protein":   n.Protein,
+		"nutrition_carbs":     n.Carbs,
+		"nutrition_fat":       n.Fat,
+		"nutrition_fiber":     n.Fiber,
+		"nutrition_unmatched": n.Unmatched,
+		"nutrition_computed":  n.Computed,
+		"version":             NextVersion(),
+	}).Error
+}
+
+// ComputePendingNutrition estimates the nutrition of the recipes created
+// before the nutrition subsystem.
+func ComputePendingNutrition() {
+	var recipes []models.Recipe
+	database.DB.Preload("Ingredients").Where("nutrition_computed = ? OR nutrition_computed IS NULL", false).Find(&recipes)
+	for i := range recipes {
+		ComputeNutrition(&recipes[i])
+		if err := SaveNutrition(&recipes[i]); err != nil {
+			log.Printf("Failed to save nutrition of recipe %d: %v", recipes[i].ID, err)
+		}
+	}
+	if len(recipes) > 0 {
+		log.Printf("Nutrition computed for %d recipes", len(recipes))
+	}
+}
+
+// SearchFoods returns the table entries whose names contain the search term.
+func SearchFoods(search string) []Food {
+	term := strings.TrimSpace(normalizeFoodText(search))
+	result := []Food{}
+	for _, f := range Foods() {
+		for _, name := range f.Names {
+			if term == "" || strings.Contains(name, term) {
+				result = append(result, f)
+				break
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
@@ -1,64 +1,153 @@
 package services
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
 	"xgastroteca/database"
 	"xgastroteca/models"
-	"xgastroteca/utils"
-)
 
-// ProcessVideo orchestrates the downloading and AI analysis of a video URL
-func ProcessVideo(url string) (*models.Recipe, error) {
-	dataPath := "./data/videos"
+	"gorm.io/gorm"
+)
 
+// ProcessVideo orchestrates the downloading and AI analysis of a video URL.
+// Cancelling ctx (e.g. the client went away) stops the download.
+func ProcessVideo(ctx context.Context, url string) (*models.Recipe, error) {
 	log.Printf("Processing URL: %s", url)
 
 	// 1. Validate Platform and Extract Info
-	source, externalID, err := utils.ExtractVideoInfo(url)
+	// Short links are resolved first, so any way of sharing a post gives the same ID
+	source, externalID, canonicalURL, err := NormalizeURL(url)
 	if err != nil {
 		return nil, fmt.Errorf("invalid URL: %v", err)
 	}
 
 	// Check if recipe already exists (Optimization: check before downloading)
 	var existingRecipe models.Recipe
-	if err := database.DB.Preload("Ingredients").Preload("Steps").Preload("Tags").Where("source = ? AND external_id = ?", source, externalID).First(&existingRecipe).Error; err == nil {
+	if err := database.DB.Preload("Ingredients").Preload("Steps").Preload("Tags").Where("(source = ? AND external_id = ?) OR canonical_url = ?", source, externalID, canonicalURL).First(&existingRecipe).Error; err == nil {
 		log.Printf("Receta duplicada encontrada: Source=%s, ID=%s", source, externalID)
 		return &existingRecipe, nil
 	}
 
+	// Also check URLs already linked as reposts of another recipe
+	var alternate models.RecipeSource
+	if err := database.DB.Where("source = ? AND external_id = ?", source, externalID).First(&alternate).Error; err == nil {
+		if err := database.DB.Preload("Ingredients").Preload("Steps").Preload("Tags").First(&existingRecipe, alternate.RecipeID).Error; err == nil {
+			log.Printf("Receta duplicada encontrada (fuente alternativa): Source=%s, ID=%s", source, externalID)
+			return &existingRecipe, nil
+		}
+	}
+
+	// Recipe blogs and other pages without a video
+	if source == models.SourceWeb {
+		return ProcessWebPage(url, externalID, canonicalURL)
+	}
+
 	// Generate a unique filename to ensure we know the path
 	filename := fmt.Sprintf("video_%d.mp4", time.Now().UnixNano())
-	fullPath := filepath.Join(dataPath, filename)
-
-	// Using yt-dlp to download
-	cmd := exec.Command("yt-dlp",
-		"-o", fullPath,
-		"-f", "bestvideo+bestaudio/best",
-		"--merge-output-format", "mp4",
-		"--write-thumbnail",
-		"--convert-thumbnails", "jpg",
-		url,
-	)
-
-	// Capture output for debugging (optional, maybe redirect to log if needed)
-	// cmd.Stdout = os.Stdout
-	// cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
+	fullPath := filepath.Join(videosPath, filename)
+
+	// Download with yt-dlp (cookies, proxy and limits come from the environment)
+	result, err := NewDownloader().Download(ctx, DownloadRequest{
+		URL:        url,
+		Source:     source,
+		OutputPath: fullPath,
+	})
+	if err != nil {
 		log.Printf("Error downloading video: %v", err)
-		return nil, fmt.Errorf("failed to download video: %v", err)
+		removeDownloadFiles(fullPath)
+		return nil, err
+	}
+
+	log.Printf("Video downloaded to: %s", fullPath)
+
+	// Read post metadata (caption, creator...) written by yt-dlp
+	var metadata *models.SourceMetadata
+	if result.InfoPath != "" {
+		metadata, err = LoadSourceMetadata(result.InfoPath)
+		if err != nil {
+			log.Printf("No source metadata available: %v", err)
+		}
+		os.Remove(result.InfoPath)
+	}
+
+	return analyzeLocalVideo(fullPath, source, externalID, canonicalURL, "", metadata)
+}
+
+// ProcessUploadedVideo runs the analysis pipeline on a video file uploaded by
+// the user (already stored in the videos directory). The recipe is saved with
+// Source "upload" and the SHA-256 of the file as ExternalID.
+func ProcessUploadedVideo(fullPath string) (*models.Recipe, error) {
+	log.Printf("Processing uploaded file: %s", fullPath)
+
+	contentHash, err := HashFile(fullPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash uploaded file: %v", err)
 	}
 
-	log.Printf("Video downloaded to: %s. Starting AI analysis...", fullPath)
+	var existingRecipe models.Recipe
+	if err := database.DB.Preload("Ingredients").Preload("Steps").Preload("Tags").Where("source = ? AND external_id = ?", models.SourceUpload, contentHash).First(&existingRecipe).Error; err == nil {
+		log.Printf("Receta duplicada encontrada: Source=%s, ID=%s", models.SourceUpload, contentHash)
+		os.Remove(fullPath)
+		return &existingRecipe, nil
+	}
+
+	return analyzeLocalVideo(fullPath, models.SourceUpload, contentHash, "", contentHash, nil)
+}
+
+// analyzeLocalVideo is the part of the pipeline shared by downloaded and uploaded
+// videos: repost detection, transcription, AI analysis, images and saving.
+// url is the canonical URL of the post (empty for uploads).
+// contentHash may be empty, it is computed then.
+func analyzeLocalVideo(fullPath, source, externalID, url, contentHash string, metadata *models.SourceMetadata) (*models.Recipe, error) {
+	// Detect reposts of a video we already have (same file or same frames)
+	if contentHash == "" {
+		var err error
+		contentHash, err = HashFile(fullPath)
+		if err != nil {
+			log.Printf("Failed to hash video: %v", err)
+		}
+	}
+	perceptualHash := PerceptualHash(fullPath)
+
+	if existing := FindRecipeByMedia(contentHash, perceptualHash); existing != nil {
+		log.Printf("Video already analyzed as recipe %d, linking as alternate source", existing.ID)
+		LinkAlternateSource(existing, source, externalID, url)
+		os.Remove(fullPath)
+		os.Remove(strings.TrimSuffix(fullPath, filepath.Ext(fullPath)) + ".jpg")
+
+		database.DB.Preload("Ingredients").Preload("Steps").Preload("Tags").First(existing, existing.ID)
+		return existing, nil
+	}
+
+	// Mobile friendly rendition (H.264/AAC, optional HLS); the rest of the
+	// pipeline works on it, the original is kept or removed by policy
+	originalPath := fullPath
+	transcodeSettings := TranscodeSettingsFromEnv()
+	rendition, err := TranscodeVideo(fullPath, transcodeSettings)
+	if err != nil {
+		log.Printf("Transcoding failed, keeping the original video: %v", err)
+	}
+	fullPath = rendition.VideoPath
+
+	log.Printf("Starting transcription...")
+
+	// Transcribe audio (optional, empty when whisper is not configured)
+	transcript := TranscribeVideo(fullPath)
+
+	log.Printf("Starting AI analysis...")
 
 	// Call AI Service
-	recipe, err := AnalyzeVideo(fullPath)
+	recipes, err := AnalyzeVideo(fullPath, AnalysisContext{
+		Transcript:     transcript,
+		Metadata:       metadata,
+		ContentHash:    contentHash,
+		PerceptualHash: perceptualHash,
+	})
 	if err != nil {
 		log.Printf("Error analyzing video: %v", err)
 		// Clean up video if it's not a recipe or if analysis failed
@@ -66,6 +155,10 @@ func ProcessVideo(url string) (*models.Recipe, error) {
 		// For now, following original logic: delete if not a recipe.
 		if err.Error() == "not_a_recipe" {
 			os.Remove(fullPath)
+			os.Remove(originalPath)
+			if rendition.HLSPath != "" {
+				os.RemoveAll(filepath.Dir(rendition.HLSPath))
+			}
 			return nil, err // Return specific error
 		}
 
@@ -75,23 +168,114 @@ func ProcessVideo(url string) (*models.Recipe, error) {
 		return nil, err
 	}
 
-	// Populate Multi-Platform ID
-	recipe.Source = source
-	recipe.ExternalID = externalID
+	// Thumbnail written by yt-dlp (uploads don't have one)
+	thumbnailFullPath := strings.TrimSuffix(originalPath, filepath.Ext(originalPath)) + ".jpg"
+	thumbnailPath := ""
+	if _, err := os.Stat(thumbnailFullPath); err == nil {
+		thumbnailPath = "videos/" + filepath.Base(thumbnailFullPath)
+	}
 
-	// Optimize LocalVideoPath for frontend (URL friendly)
-	recipe.LocalVideoPath = "videos/" + filepath.Base(fullPath)
+	// Every recipe of the video shares the file and the source, told apart by Part
+	thumbnailUsed := false
+	for _, recipe := range recipes {
+		// Populate Multi-Platform ID
+		recipe.Source = source
+		recipe.ExternalID = externalID
+		recipe.CanonicalURL = url
+		if metadata != nil {
+			recipe.SourceMeta = *metadata
+		}
 
-	// Set Thumbnail Path
-	thumbnailFullPath := strings.TrimSuffix(fullPath, filepath.Ext(fullPath)) + ".jpg"
-	recipe.ThumbnailPath = "videos/" + filepath.Base(thumbnailFullPath)
+		// Optimize LocalVideoPath for frontend (URL friendly)
+		recipe.LocalVideoPath = "videos/" + filepath.Base(fullPath)
+		recipe.ThumbnailPath = thumbnailPath
+		if rendition.Transcoded && transcodeSettings.KeepOriginal {
+			recipe.OriginalVideoPath = "videos/" + filepath.Base(originalPath)
+		}
+		if rendition.HLSPath != "" {
+			recipe.StreamPath = "videos/" + filepath.Base(filepath.Dir(rendition.HLSPath)) + "/" + filepath.Base(rendition.HLSPath)
+		}
+
+		// Better cover and per-step stills from the video keyframes
+		GenerateRecipeImages(recipe, fullPath)
+		if thumbnailPath != "" && recipe.ThumbnailPath == thumbnailPath {
+			thumbnailUsed = true
+		}
+
+		// Smaller sizes for the app, with WebP and a BlurHash placeholder
+		if err := GenerateThumbnails(recipe); err != nil {
+			log.Printf("Failed to generate thumbnails: %v", err)
+		}
+
+		// Estimate nutrition from the offline nutrient table
+		ComputeNutrition(recipe)
+
+		// Allergens and vegetarian/vegan flags
+		ClassifyRecipe(recipe)
+
+		// Original language (the AI usually reports it, detect it otherwise)
+		recipe.Language = RecipeLanguage(recipe)
+	}
+
+	// The yt-dlp thumbnail is no longer needed when every recipe got a cover
+	if thumbnailPath != "" && !thumbnailUsed {
+		os.Remove(thumbnailFullPath)
+	}
+
+	// Move the files to the media store before the recipes point to them
+	if err := PublishRecipeMedia(recipes); err != nil {
+		log.Printf("Error storing media: %v", err)
+		return nil, err
+	}
 
 	// Save to Database
-	if result := database.DB.Create(recipe); result.Error != nil {
-		log.Printf("Error saving to database: %v", result.Error)
-		return nil, fmt.Errorf("failed to save recipe: %v", result.Error)
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		for _, recipe := range recipes {
+			if err := tx.Create(recipe).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error saving to database: %v", err)
+		return nil, fmt.Errorf("failed to save recipe: %v", err)
+	}
+
+	for _, recipe := range recipes {
+		log.Printf("Recipe saved with ID: %d (part %d)", recipe.ID, recipe.Part)
+	}
+
+	// The downloaded file is replaced by the rendition unless configured otherwise
+	if rendition.Transcoded && !transcodeSettings.KeepOriginal {
+		os.Remove(originalPath)
+	}
+	return recipes[0], nil
+}
+
+// RecipeParts returns all the recipes extracted from the same video as recipe, in order.
+func RecipeParts(recipe *models.Recipe) []models.Recipe {
+	var parts []models.Recipe
+	database.DB.Where("source = ? AND external_id = ?", recipe.Source, recipe.ExternalID).Order("part").Find(&parts)
+	return parts
+}
+
+// MediaReferenced reports whether a media path (e.g. videos/video_123.mp4) is used
+// by any recipe other than excludeRecipeID. Variants share the files of the original.
+func MediaReferenced(path string, excludeRecipeID uint) bool {
+	if path == "" {
+		return false
+	}
+
+	var count int64
+	database.DB.Model(&models.Recipe{}).
+		Where("id <> ? AND (local_video_path = ? OR original_video_path = ? OR stream_path = ? OR thumbnail_path = ? OR thumbnails_card_jpeg = ? OR thumbnails_card_webp = ? OR thumbnails_header_jpeg = ? OR thumbnails_header_webp = ?)",
+			excludeRecipeID, path, path, path, path, path, path, path, path).
+		Count(&count)
+	if count > 0 {
+		return true
 	}
 
-	log.Printf("Recipe saved with ID: %d", recipe.ID)
-	return recipe, nil
+	database.DB.Model(&models.Step{}).Where("recipe_id <> ? AND image_path = ?", excludeRecipeID, path).Count(&count)
+	return count > 0
 }
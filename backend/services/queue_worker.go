@@ -1,25 +1,33 @@
 package services
 
 import (
+	"context"
 	"log"
+	"strings"
 	"time"
 	"xgastroteca/database"
 	"xgastroteca/models"
 )
 
 // StartQueueWorker starts a background goroutine that checks for pending jobs
-func StartQueueWorker() {
+// until ctx is cancelled.
+func StartQueueWorker(ctx context.Context) {
 	go func() {
 		ticker := time.NewTicker(1 * time.Minute)
 		defer ticker.Stop()
 
-		for range ticker.C {
-			processPendingJobs()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				processPendingJobs(ctx)
+			}
 		}
 	}()
 }
 
-func processPendingJobs() {
+func processPendingJobs(ctx context.Context) {
 	var jobs []models.ProcessingJob
 
 	// Find jobs that are PENDING and due for retry
@@ -30,6 +38,9 @@ func processPendingJobs() {
 	}
 
 	for _, job := range jobs {
+		if ctx.Err() != nil {
+			return
+		}
 		log.Printf("Processing queued job ID %d for URL: %s", job.ID, job.URL)
 
 		// Update status to PROCESSING
@@ -44,7 +55,21 @@ func processPendingJobs() {
 		// we will instantiate it or call a singleton if available.
 		// Looking at the structure, we probably need to invoke the same logic as the /process endpoint.
 
-		recipe, err := ProcessVideo(job.URL)
+		var recipe *models.Recipe
+		if IsUploadJob(job.URL) {
+			recipe, err = ProcessUploadedVideo(strings.TrimPrefix(job.URL, uploadJobScheme))
+		} else {
+			recipe, err = ProcessVideo(ctx, job.URL)
+		}
+
+		// Interrupted by the shutdown: run it again on the next start
+		if err != nil && ctx.Err() != nil {
+			log.Printf("Job %d interrupted: %v", job.ID, err)
+			database.DB.Model(&job).Updates(map[string]interface{}{
+				"status": models.JobStatusPending,
+			})
+			return
+		}
 
 		if err != nil {
 			log.Printf("Job %d failed: %v", job.ID, err)
@@ -71,8 +96,11 @@ func processPendingJobs() {
 		} else {
 			log.Printf("Job %d completed successfully. Recipe ID: %d", job.ID, recipe.ID)
 			database.DB.Model(&job).Updates(map[string]interface{}{
-				"status":    models.JobStatusCompleted,
-				"error_msg": "",
+				"status":             models.JobStatusCompleted,
+				"error_msg":          "",
+				"ai_model":           recipe.AIUsage.Model,
+				"ai_prompt_tokens":   recipe.AIUsage.PromptTokens,
+				"ai_response_tokens": recipe.AIUsage.ResponseTokens,
 			})
 		}
 	}
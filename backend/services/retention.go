@@ -0,0 +1,437 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"xgastroteca/database"
+	"xgastroteca/models"
+	"xgastroteca/storage"
+)
+
+// Reasons for removing a video
+const (
+	RetentionArchived = "archived" // Cooked and archived by the user
+	RetentionAge      = "age"      // Older than MEDIA_VIDEO_RETENTION_DAYS
+	RetentionQuota    = "quota"    // Oldest videos, to get under MEDIA_MAX_TOTAL_MB
+)
+
+// RetentionPolicy decides which videos are removed to save disk space.
+// Thumbnails and step stills are always kept, they are small.
+type RetentionPolicy struct {
+	MaxTotalBytes      int64 `json:"max_total_bytes"`      // 0 for no limit
+	VideoRetentionDays int   `json:"video_retention_days"` // 0 to keep videos forever
+	DropArchivedVideos bool  `json:"drop_archived_videos"`
+}
+
+// RetentionPolicyFromEnv reads the policy from MEDIA_MAX_TOTAL_MB,
+// MEDIA_VIDEO_RETENTION_DAYS and MEDIA_DROP_ARCHIVED_VIDEOS.
+func RetentionPolicyFromEnv() RetentionPolicy {
+	p := RetentionPolicy{DropArchivedVideos: os.Getenv("MEDIA_DROP_ARCHIVED_VIDEOS") == "true"}
+	if mb, err := strconv.ParseInt(os.Getenv("MEDIA_MAX_TOTAL_MB"), 10, 64); err == nil && mb > 0 {
+		p.MaxTotalBytes = mb << 20
+	}
+	if days, err := strconv.Atoi(os.Getenv("MEDIA_VIDEO_RETENTION_DAYS")); err == nil && days > 0 {
+		p.VideoRetentionDays = days
+	}
+	return p
+}
+
+// MediaUsageFile is a stored file of a recipe.
+type MediaUsageFile struct {
+	Key    string `json:"key"`
+	Kind   string `json:"kind"` // video, original_video, stream, thumbnail, thumbnail_variant, step_image
+	Size   int64  `json:"size"`
+	Shared bool   `json:"shared"` // Also used by other recipes (parts, variants)
+}
+
+// RecipeMediaUsage is the disk space used by a recipe.
+type RecipeMediaUsage struct {
+	RecipeID       uint             `json:"recipe_id"`
+	Title          string           `json:"title"`
+	TotalBytes     int64            `json:"total_bytes"`
+	VideoBytes     int64            `json:"video_bytes"` // Video, original and HLS segments
+	VideoRemovedAt *time.Time       `json:"video_removed_at"`
+	Files          []MediaUsageFile `json:"files"`
+}
+
+// MediaUsageReport is the disk space used by all the recipes.
+type MediaUsageReport struct {
+	TotalBytes int64              `json:"total_bytes"`
+	Policy     RetentionPolicy    `json:"policy"`
+	OverQuota  bool               `json:"over_quota"`
+	Recipes    []RecipeMediaUsage `json:"recipes"` // Largest first
+}
+
+// storedSizes returns the size of every stored media file.
+func storedSizes() (map[string]int64, int64, error) {
+	objects, err := storage.Media.List(context.Background(), "videos/")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list media: %v", err)
+	}
+	sizes := make(map[string]int64, len(objects))
+	var total int64
+	for _, obj := range objects {
+		sizes[obj.Key] = obj.Size
+		total += obj.Size
+	}
+	return sizes, total, nil
+}
+
+// videoKeys lists the video files of a recipe: rendition, original and HLS segments.
+func videoKeys(recipe *models.Recipe, sizes map[string]int64) []string {
+	var keys []string
+	for _, key := range []string{recipe.LocalVideoPath, recipe.OriginalVideoPath} {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	if recipe.StreamPath != "" {
+		dir := path.Dir(recipe.StreamPath) + "/"
+		for key := range sizes {
+			if strings.HasPrefix(key, dir) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// recipeUsage computes the files of a recipe. users counts the recipes using each key.
+func recipeUsage(recipe *models.Recipe, sizes map[string]int64, users map[string]int) RecipeMediaUsage {
+	usage := RecipeMediaUsage{RecipeID: recipe.ID, Title: recipe.Title, VideoRemovedAt: recipe.VideoRemovedAt}
+
+	add := func(key, kind string) {
+		size := sizes[key]
+		usage.Files = append(usage.Files, MediaUsageFile{Key: key, Kind: kind, Size: size, Shared: users[key] > 1})
+		usage.TotalBytes += size
+		if kind == "video" || kind == "original_video" || kind == "stream" {
+			usage.VideoBytes += size
+		}
+	}
+
+	for _, key := range videoKeys(recipe, sizes) {
+		switch key {
+		case recipe.LocalVideoPath:
+			add(key, "video")
+		case recipe.OriginalVideoPath:
+			add(key, "original_video")
+		default:
+			add(key, "stream")
+		}
+	}
+	if recipe.ThumbnailPath != "" {
+		add(recipe.ThumbnailPath, "thumbnail")
+	}
+	for _, key := range thumbnailVariantKeys(recipe) {
+		add(key, "thumbnail_variant")
+	}
+	for _, step := range recipe.Steps {
+		if step.ImagePath != "" {
+			add(step.ImagePath, "step_image")
+		}
+	}
+	return usage
+}
+
+// mediaUsers counts how many recipes use each key.
+func mediaUsers(recipes []models.Recipe, sizes map[string]int64) map[string]int {
+	users := make(map[string]int)
+	for i := range recipes {
+		keys := append(videoKeys(&recipes[i], sizes), recipeMediaKeys(&recipes[i])...)
+		seen := make(map[string]bool)
+		for _, key := range keys {
+			if !seen[key] {
+				seen[key] = true
+				users[key]++
+			}
+		}
+	}
+	return users
+}
+
+// MediaUsage reports the disk space used by every recipe.
+func MediaUsage() (*MediaUsageReport, error) {
+	sizes, total, err := storedSizes()
+	if err != nil {
+		return nil, err
+	}
+
+	var recipes []models.Recipe
+	if err := database.DB.Preload("Steps").Find(&recipes).Error; err != nil {
+		return nil, fmt.Errorf("failed to load recipes: %v", err)
+	}
+	users := mediaUsers(recipes, sizes)
+
+	report := &MediaUsageReport{TotalBytes: total, Policy: RetentionPolicyFromEnv()}
+	report.OverQuota = report.Policy.MaxTotalBytes > 0 && total > report.Policy.MaxTotalBytes
+	for i := range recipes {
+		report.Recipes = append(report.Recipes, recipeUsage(&recipes[i], sizes, users))
+	}
+	sort.SliceStable(report.Recipes, func(i, j int) bool {
+		return report.Recipes[i].TotalBytes > report.Recipes[j].TotalBytes
+	})
+	return report, nil
+}
+
+// RecipeMediaUsageFor reports the disk space used by one recipe.
+func RecipeMediaUsageFor(recipe *models.Recipe) (*RecipeMediaUsage, error) {
+	sizes, _, err := storedSizes()
+	if err != nil {
+		return nil, err
+	}
+
+	// Other recipes sharing the files
+	var sharing []models.Recipe
+	database.DB.Preload("Steps").Where("id = ? OR (local_video_path != '' AND local_video_path = ?) OR (thumbnail_path != '' AND thumbnail_path = ?)",
+		recipe.ID, recipe.LocalVideoPath, recipe.ThumbnailPath).Find(&sharing)
+	users := mediaUsers(sharing, sizes)
+
+	usage := recipeUsage(recipe, sizes, users)
+	return &usage, nil
+}
+
+// JanitorAction is a video removed (or to be removed, in a dry run) with
+// every recipe using it.
+type JanitorAction struct {
+	Video     string `json:"video"`
+	RecipeIDs []uint `json:"recipe_ids"`
+	Bytes     int64  `json:"bytes"`
+	Reason    string `json:"reason"`
+	// Some files couldn't be deleted: Bytes and Removed are what was, and the
+	// recipes keep the video (see the errors of the report)
+	Partial bool     `json:"partial,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// JanitorReport is the result of applying the retention policy.
+type JanitorReport struct {
+	DryRun     bool            `json:"dry_run"`
+	Policy     RetentionPolicy `json:"policy"`
+	TotalBytes int64           `json:"total_bytes"` // Before the run
+	FreedBytes int64           `json:"freed_bytes"`
+	OverQuota  bool            `json:"over_quota"` // Still over the limit after the run
+	Actions    []JanitorAction `json:"actions"`
+	Errors     []string        `json:"errors,omitempty"`
+}
+
+// videoGroup is a video file and the recipes using it (parts and variants).
+type videoGroup struct {
+	video   string
+	recipes []models.Recipe
+	keys    []string
+	bytes   int64
+	newest  time.Time
+}
+
+// allRecipes reports whether every recipe of the group matches.
+func (g *videoGroup) allRecipes(match func(r *models.Recipe) bool) bool {
+	for i := range g.recipes {
+		if !match(&g.recipes[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// RunJanitor applies the retention policy: videos of archived recipes, videos
+// older than the retention period and, while over the quota, the oldest
+// videos. A video shared by several recipes is only removed when all of them
+// qualify. With dryRun nothing is deleted.
+func RunJanitor(policy RetentionPolicy, dryRun bool) (*JanitorReport, error) {
+	sizes, total, err := storedSizes()
+	if err != nil {
+		return nil, err
+	}
+	report := &JanitorReport{DryRun: dryRun, Policy: policy, TotalBytes: total}
+
+	var recipes []models.Recipe
+	if err := database.DB.Where("local_video_path != ''").Order("created_at").Find(&recipes).Error; err != nil {
+		return nil, fmt.Errorf("failed to load recipes: %v", err)
+	}
+
+	// Group the recipes by video file
+	var groups []*videoGroup
+	byVideo := make(map[string]*videoGroup)
+	for _, r := range recipes {
+		g := byVideo[r.LocalVideoPath]
+		if g == nil {
+			g = &videoGroup{video: r.LocalVideoPath}
+			byVideo[r.LocalVideoPath] = g
+			groups = append(groups, g)
+		}
+		g.recipes = append(g.recipes, r)
+		if r.CreatedAt.After(g.newest) {
+			g.newest = r.CreatedAt
+		}
+		for _, key := range videoKeys(&r, sizes) {
+			if !containsString(g.keys, key) {
+				g.keys = append(g.keys, key)
+				g.bytes += sizes[key]
+			}
+		}
+	}
+
+	remaining := total
+	var kept []*videoGroup
+	for _, g := range groups {
+		reason := ""
+		switch {
+		case policy.DropArchivedVideos && g.allRecipes(func(r *models.Recipe) bool { return r.Cooked && r.Archived }):
+			reason = RetentionArchived
+		case policy.VideoRetentionDays > 0 && g.newest.Before(time.Now().AddDate(0, 0, -policy.VideoRetentionDays)):
+			reason = RetentionAge
+		}
+		if reason == "" {
+			kept = append(kept, g)
+			continue
+		}
+		remaining -= applyRetention(report, g, sizes, reason, dryRun)
+	}
+
+	// Oldest videos first until the media fits in the quota
+	if policy.MaxTotalBytes > 0 {
+		sort.SliceStable(kept, func(i, j int) bool { return kept[i].newest.Before(kept[j].newest) })
+		for _, g := range kept {
+			if remaining <= policy.MaxTotalBytes {
+				break
+			}
+			remaining -= applyRetention(report, g, sizes, RetentionQuota, dryRun)
+		}
+		report.OverQuota = remaining > policy.MaxTotalBytes
+	}
+
+	report.FreedBytes = total - remaining
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+	log.Printf("Media janitor: %s %d videos (%d MB)", verb, len(report.Actions), report.FreedBytes>>20)
+	return report, nil
+}
+
+// applyRetention removes the video files of a group and clears them from its
+// recipes. Returns the bytes freed.
+func applyRetention(report *JanitorReport, g *videoGroup, sizes map[string]int64, reason string, dryRun bool) int64 {
+	action := JanitorAction{Video: g.video, Bytes: g.bytes, Reason: reason}
+	for _, r := range g.recipes {
+		action.RecipeIDs = append(action.RecipeIDs, r.ID)
+	}
+
+	if !dryRun {
+		// The rendition goes last, so the recipes stay playable if a deletion fails
+		keys := make([]string, 0, len(g.keys))
+		for _, key := range g.keys {
+			if key != g.video {
+				keys = append(keys, key)
+			}
+		}
+		keys = append(keys, g.video)
+
+		ctx := context.Background()
+		var removed []string
+		var freed int64
+		for _, key := range keys {
+			if err := storage.Media.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", key, err))
+				break
+			}
+			removed = append(removed, key)
+			freed += sizes[key]
+		}
+		if len(removed) < len(keys) {
+			if len(removed) == 0 {
+				return 0
+			}
+			action.Partial = true
+			action.Removed = removed
+			action.Bytes = freed
+			clearRemovedMedia(report, g, removed)
+			report.Actions = append(report.Actions, action)
+			return freed
+		}
+
+		now := time.Now()
+		err := database.DB.Model(&models.Recipe{}).Where("id IN ?", action.RecipeIDs).Updates(map[string]interface{}{
+			"local_video_path":    "",
+			"original_video_path": "",
+			"stream_path":         "",
+			"video_removed_at":    &now,
+			"version":             NextVersion(),
+		}).Error
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: failed to update recipes: %v", g.video, err))
+		}
+	}
+
+	report.Actions = append(report.Actions, action)
+	return g.bytes
+}
+
+// clearRemovedMedia clears the original video and HLS stream of the recipes
+// of a group when their files were removed, keeping the rendition.
+func clearRemovedMedia(report *JanitorReport, g *videoGroup, removed []string) {
+	for _, r := range g.recipes {
+		updates := map[string]interface{}{}
+		if r.OriginalVideoPath != "" && containsString(removed, r.OriginalVideoPath) {
+			updates["original_video_path"] = ""
+		}
+		if r.StreamPath != "" {
+			dir := path.Dir(r.StreamPath) + "/"
+			for _, key := range removed {
+				if strings.HasPrefix(key, dir) {
+					updates["stream_path"] = ""
+					break
+				}
+			}
+		}
+		if len(updates) == 0 {
+			continue
+		}
+		updates["version"] = NextVersion()
+		if err := database.DB.Model(&models.Recipe{}).Where("id = ?", r.ID).Updates(updates).Error; err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: failed to update recipe %d: %v", g.video, r.ID, err))
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// StartJanitor applies the retention policy periodically (JANITOR_INTERVAL_HOURS,
+// 0 disables it). With JANITOR_DRY_RUN=true it only logs what it would remove.
+func StartJanitor() {
+	hours := 24
+	if h, err := strconv.Atoi(os.Getenv("JANITOR_INTERVAL_HOURS")); err == nil && h >= 0 {
+		hours = h
+	}
+	policy := RetentionPolicyFromEnv()
+	if hours == 0 || policy == (RetentionPolicy{}) {
+		return
+	}
+	dryRun := os.Getenv("JANITOR_DRY_RUN") == "true"
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(hours) * time.Hour)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if _, err := RunJanitor(policy, dryRun); err != nil {
+				log.Printf("Media janitor failed: %v", err)
+			}
+		}
+	}()
+}
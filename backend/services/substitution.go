@@ -0,0 +1,268 @@
+package services
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"xgastroteca/database"
+	"xgastroteca/models"
+	"xgastroteca/utils"
+)
+
+// Curated substitution table: ingredient names, substitute, quantity factor, ratio and notes.
+//
+//go:embed substitutions.csv
+var substitutionsCSV string
+
+// Substitution is an alternative for an ingredient.
+type Substitution struct {
+	Substitute string   `json:"substitute"`
+	Quantity   string   `json:"quantity,omitempty"` // Adjusted quantity when it can be computed
+	Ratio      string   `json:"ratio"`
+	Notes      string   `json:"notes,omitempty"`
+	Source     string   `json:"source"` // local or ai
+	Allergens  []string `json:"allergens"`
+	Vegetarian bool     `json:"vegetarian"`
+	Vegan      bool     `json:"vegan"`
+}
+
+// IngredientSubstitutions groups the alternatives of one ingredient.
+type IngredientSubstitutions struct {
+	IngredientID  uint           `json:"ingredient_id"`
+	Item          string         `json:"item"`
+	Quantity      string         `json:"quantity"`
+	Substitutions []Substitution `json:"substitutions"`
+}
+
+type substitutionEntry struct {
+	names      []string
+	substitute string
+	factor     float64
+	ratio      string
+	notes      string
+}
+
+var (
+	substitutionsOnce sync.Once
+	substitutions     []substitutionEntry
+)
+
+func loadSubstitutions() {
+	records, err := csv.NewReader(strings.NewReader(substitutionsCSV)).ReadAll()
+	if err != nil {
+		log.Printf("Failed to load substitution table: %v", err)
+		return
+	}
+
+	for _, rec := range records[1:] {
+		var names []string
+		for _, n := range strings.Split(rec[0], "|") {
+			names = append(names, normalizeFoodText(n))
+		}
+		factor, _ := strconv.ParseFloat(rec[2], 64)
+		substitutions = append(substitutions, substitutionEntry{
+			names:      names,
+			substitute: rec[1],
+			factor:     factor,
+			ratio:      rec[3],
+			notes:      rec[4],
+		})
+	}
+}
+
+// localSubstitutions returns the curated alternatives for an ingredient.
+// Only the entries with the most specific (longest) name match are used,
+// so "harina de maíz" doesn't get the alternatives of "harina".
+func localSubstitutions(ing models.Ingredient) []Substitution {
+	substitutionsOnce.Do(loadSubstitutions)
+	text := normalizeFoodText(ing.Item)
+
+	bestLen := 0
+	var matches []substitutionEntry
+	for _, entry := range substitutions {
+		entryLen := 0
+		for _, name := range entry.names {
+			if len(name) > entryLen && strings.Contains(text, name) {
+				entryLen = len(name)
+			}
+		}
+		switch {
+		case entryLen == 0 || entryLen < bestLen:
+		case entryLen > bestLen:
+			bestLen = entryLen
+			matches = []substitutionEntry{entry}
+		default:
+			matches = append(matches, entry)
+		}
+	}
+
+	var result []Substitution
+	for _, m := range matches {
+		result = append(result, Substitution{
+			Substitute: m.substitute,
+			Quantity:   adjustQuantity(ing.Quantity, m.factor),
+			Ratio:      m.ratio,
+			Notes:      m.notes,
+			Source:     "local",
+		})
+	}
+	return result
+}
+
+// adjustQuantity applies a factor to a quantity like "200 g". Returns "" if it can't.
+func adjustQuantity(quantity string, factor float64) string {
+	if factor <= 0 {
+		return ""
+	}
+	amount, unit, ok := utils.ParseQuantity(quantity)
+	if !ok {
+		return ""
+	}
+	value := strconv.FormatFloat(round1(amount*factor), 'f', -1, 64)
+	return strings.TrimSpace(value + " " + unit)
+}
+
+// aiSubstitutionsDTO is the JSON answer requested from the AI.
+type aiSubstitutionsDTO struct {
+	Ingredients []struct {
+		Ingredient string `json:"ingredient"`
+		Options    []struct {
+			Substitute string `json:"substitute"`
+			Ratio      string `json:"ratio"`
+			Notes      string `json:"notes"`
+		} `json:"options"`
+	} `json:"ingredients"`
+}
+
+// aiSubstitutions asks the AI provider for alternatives of the given ingredients.
+// Answers are cached per ingredient name, so each ingredient is asked once.
+func aiSubstitutions(items []string) (map[string][]Substitution, error) {
+	result := make(map[string][]Substitution)
+
+	var missing []string
+	requested := make(map[string][]string) // Normalized name -> items asked with it
+	for _, item := range items {
+		key := strings.TrimSpace(normalizeFoodText(item))
+		var cached []models.SubstitutionCache
+		database.DB.Where("ingredient = ?", key).Find(&cached)
+		if len(cached) == 0 {
+			missing = append(missing, item)
+			requested[key] = append(requested[key], item)
+			continue
+		}
+		for _, c := range cached {
+			result[item] = append(result[item], Substitution{Substitute: c.Substitute, Ratio: c.Ratio, Notes: c.Notes, Source: "ai"})
+		}
+	}
+
+	if len(missing) == 0 {
+		return result, nil
+	}
+
+	itemsJSON, _ := json.Marshal(missing)
+	prompt := fmt.Sprintf("Eres un chef experto. Para cada ingrediente de la lista, sugiere hasta 3 sustitutos habituales en una cocina española. Incluye alternativas sin gluten, sin lactosa o veganas cuando existan. Devuelve un JSON con el formato {\"ingredients\": [{\"ingredient\": \"<nombre exacto de la lista>\", \"options\": [{\"substitute\": \"...\", \"ratio\": \"proporción de cambio\", \"notes\": \"consejo breve\"}]}]}. Responde SOLO con el JSON limpio, sin bloques de código markdown.\n\n%s", itemsJSON)
+
+	jsonText, _, err := generateText("substitutions", prompt)
+	if err != nil {
+		return result, err
+	}
+
+	var dto aiSubstitutionsDTO
+	if err := json.Unmarshal([]byte(jsonText), &dto); err != nil {
+		return result, fmt.Errorf("failed to parse JSON response: %v \nRaw text: %s", err, jsonText)
+	}
+
+	// The AI may echo the names with other case or accents, match them normalized
+	for _, ing := range dto.Ingredients {
+		key := strings.TrimSpace(normalizeFoodText(ing.Ingredient))
+		for _, opt := range ing.Options {
+			if opt.Substitute == "" {
+				continue
+			}
+			database.DB.Create(&models.SubstitutionCache{Ingredient: key, Substitute: opt.Substitute, Ratio: opt.Ratio, Notes: opt.Notes})
+			for _, item := range requested[key] {
+				result[item] = append(result[item], Substitution{Substitute: opt.Substitute, Ratio: opt.Ratio, Notes: opt.Notes, Source: "ai"})
+			}
+		}
+	}
+	return result, nil
+}
+
+// SuggestSubstitutions returns alternatives for every ingredient of a recipe:
+// curated ones first, and AI ones for ingredients without a curated entry
+// (when useAI is true). Alternatives that would add an allergen the recipe
+// doesn't have, one of excludeAllergens, or break the vegetarian/vegan
+// flags of the recipe are left out.
+func SuggestSubstitutions(recipe *models.Recipe, excludeAllergens []string, useAI bool) ([]IngredientSubstitutions, error) {
+	result := []IngredientSubstitutions{}
+	var pending []string
+
+	for _, ing := range recipe.Ingredients {
+		result = append(result, IngredientSubstitutions{
+			IngredientID:  ing.ID,
+			Item:          ing.Item,
+			Quantity:      ing.Quantity,
+			Substitutions: localSubstitutions(ing),
+		})
+		if len(result[len(result)-1].Substitutions) == 0 {
+			pending = append(pending, ing.Item)
+		}
+	}
+
+	var aiErr error
+	if useAI && len(pending) > 0 {
+		var suggestions map[string][]Substitution
+		suggestions, aiErr = aiSubstitutions(pending)
+		for i := range result {
+			if len(result[i].Substitutions) > 0 {
+				continue
+			}
+			for _, s := range suggestions[result[i].Item] {
+				s.Quantity = ""
+				result[i].Substitutions = append(result[i].Substitutions, s)
+			}
+		}
+	}
+
+	// Dietary adjustment
+	recipeAllergens := make(map[string]bool)
+	for _, a := range strings.Split(recipe.Dietary.Allergens, ",") {
+		recipeAllergens[a] = true
+	}
+	for _, a := range excludeAllergens {
+		recipeAllergens[a] = false
+	}
+
+	for i := range result {
+		filtered := []Substitution{}
+		for _, s := range result[i].Substitutions {
+			info, _ := ClassifyDiet([]models.Ingredient{{Item: s.Substitute}})
+			s.Vegetarian = info.Vegetarian
+			s.Vegan = info.Vegan
+			s.Allergens = []string{}
+			allowed := true
+			if info.Allergens != "" {
+				for _, a := range strings.Split(info.Allergens, ",") {
+					s.Allergens = append(s.Allergens, a)
+					if !recipeAllergens[a] {
+						allowed = false
+					}
+				}
+			}
+			if (recipe.Dietary.Vegetarian && !s.Vegetarian) || (recipe.Dietary.Vegan && !s.Vegan) {
+				allowed = false
+			}
+			if allowed {
+				filtered = append(filtered, s)
+			}
+		}
+		result[i].Substitutions = filtered
+	}
+
+	return result, aiErr
+}
@@ -0,0 +1,328 @@
+package services
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"xgastroteca/database"
+	"xgastroteca/models"
+
+	"gorm.io/gorm"
+)
+
+const defaultTombstoneRetention = 90 * 24 * time.Hour
+
+// ErrInvalidSyncToken is returned for tokens not issued by SyncChanges.
+var ErrInvalidSyncToken = errors.New("invalid sync token")
+
+// Result of an offline edit
+const (
+	EditApplied  = "applied"
+	EditConflict = "conflict"  // The recipe changed on the server after the client copy
+	EditNotFound = "not_found" // The recipe was deleted on the server
+	EditFailed   = "failed"
+)
+
+// SyncResponse is what changed since the client's last sync.
+type SyncResponse struct {
+	Created []models.Recipe `json:"created"`
+	Updated []models.Recipe `json:"updated"`
+	Deleted []uint          `json:"deleted"`  // IDs of the recipes removed from the server
+	Token   string          `json:"token"`    // Send it in the next sync
+	HasMore bool            `json:"has_more"` // Call again right away with the new token
+	Reset   bool            `json:"reset"`    // The token was too old: drop the local copy, this is a full sync
+}
+
+// syncToken is the decoded content of the opaque token the client stores.
+type syncToken struct {
+	issuedAt time.Time     // Deletions before it were already sent
+	syncedAt time.Time     // End of the last complete sync, recipes created after it are new to the client
+	cursor   ChangesCursor // Last recipe change sent
+}
+
+func (t syncToken) encode() string {
+	var synced int64
+	if !t.syncedAt.IsZero() {
+		synced = t.syncedAt.UnixNano()
+	}
+	raw := fmt.Sprintf("v1:%d:%d:%d:%d", t.issuedAt.UnixNano(), synced, t.cursor.Since.UnixNano(), t.cursor.AfterID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeSyncToken(token string) (syncToken, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return syncToken{}, ErrInvalidSyncToken
+	}
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 5 || parts[0] != "v1" {
+		return syncToken{}, ErrInvalidSyncToken
+	}
+	issued, err1 := strconv.ParseInt(parts[1], 10, 64)
+	synced, err2 := strconv.ParseInt(parts[2], 10, 64)
+	since, err3 := strconv.ParseInt(parts[3], 10, 64)
+	afterID, err4 := strconv.ParseUint(parts[4], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return syncToken{}, ErrInvalidSyncToken
+	}
+	var syncedAt time.Time
+	if synced != 0 {
+		syncedAt = time.Unix(0, synced)
+	}
+	return syncToken{
+		issuedAt: time.Unix(0, issued),
+		syncedAt: syncedAt,
+		cursor:   ChangesCursor{Since: time.Unix(0, since), AfterID: uint(afterID)},
+	}, nil
+}
+
+// tombstoneRetention is how long deletions are remembered (SYNC_TOMBSTONE_DAYS).
+// Clients that didn't sync for longer get a full sync.
+func tombstoneRetention() time.Duration {
+	if days, err := strconv.Atoi(os.Getenv("SYNC_TOMBSTONE_DAYS")); err == nil && days > 0 {
+		return time.Duration(days) * 24 * time.Hour
+	}
+	return defaultTombstoneRetention
+}
+
+// SyncChanges returns the recipes created, updated and deleted since the
+// token (all the recipes for an empty token), at most limit recipes per call.
+func SyncChanges(token string, limit int) (*SyncResponse, error) {
+	resp := &SyncResponse{Created: []models.Recipe{}, Updated: []models.Recipe{}, Deleted: []uint{}}
+	now := time.Now()
+
+	var prev syncToken
+	if token != "" {
+		var err error
+		if prev, err = decodeSyncToken(token); err != nil {
+			return nil, err
+		}
+		// Deletions older than the retention may be gone, start over
+		if prev.issuedAt.Before(now.Add(-tombstoneRetention())) {
+			prev = syncToken{}
+			resp.Reset = true
+		}
+	}
+
+	changes, err := RecipesChangedSince(prev.cursor, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load changes: %v", err)
+	}
+	for _, r := range changes.Recipes {
+		if prev.syncedAt.IsZero() || r.CreatedAt.After(prev.syncedAt) {
+			resp.Created = append(resp.Created, r)
+		} else {
+			resp.Updated = append(resp.Updated, r)
+		}
+	}
+
+	// The first page of a full sync has nothing to delete on the client
+	if !prev.issuedAt.IsZero() {
+		var tombstones []models.RecipeTombstone
+		err := database.DB.Where("deleted_at > ? AND deleted_at <= ?", prev.issuedAt.In(time.Local), now.In(time.Local)).
+			Order("deleted_at").Find(&tombstones).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to load deletions: %v", err)
+		}
+		for _, t := range tombstones {
+			resp.Deleted = append(resp.Deleted, t.RecipeID)
+		}
+	}
+
+	next := syncToken{issuedAt: now, syncedAt: prev.syncedAt, cursor: changes.Next}
+	if !changes.HasMore {
+		next.syncedAt = now
+	}
+	resp.Token = next.encode()
+	resp.HasMore = changes.HasMore
+	return resp, nil
+}
+
+// DeleteRecipe removes a recipe, its files (unless shared with a variant) and
+// its rows, and leaves a tombstone for syncing clients.
+func DeleteRecipe(recipe *models.Recipe) error {
+	DeleteRecipeMedia(recipe)
+
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Select("Ingredients", "Steps", "Tags", "AlternateSources").Delete(recipe).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("recipe_id = ?", recipe.ID).Delete(&models.RecipeTranslation{}).Error; err != nil {
+			return err
+		}
+		err := tx.Model(&models.Recipe{}).Where("variant_of_id = ?", recipe.ID).Updates(map[string]interface{}{
+			"variant_of_id": nil,
+			"version":       NextVersion(),
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&models.RecipeTombstone{RecipeID: recipe.ID, DeletedAt: time.Now()}).Error
+	})
+}
+
+// PruneTombstones removes the deletions older than the retention.
+func PruneTombstones() {
+	cutoff := time.Now().Add(-tombstoneRetention())
+	result := database.DB.Where("deleted_at < ?", cutoff.In(time.Local)).Delete(&models.RecipeTombstone{})
+	if result.Error != nil {
+		log.Printf("Failed to prune tombstones: %v", result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("Pruned %d recipe tombstones", result.RowsAffected)
+	}
+}
+
+// RecipeEdit is a change made by the client while offline. Version is the
+// recipe version the edit was based on; nil fields are left as they are.
+type RecipeEdit struct {
+	ID          uint      `json:"id" binding:"required"`
+	Version     int       `json:"version" binding:"required"`
+	Deleted     bool      `json:"deleted"`
+	Title       *string   `json:"title"`
+	Description *string   `json:"description"`
+	CookingTime *string   `json:"cooking_time"`
+	Servings    *int      `json:"servings" binding:"omitempty,min=0"`
+	Cooked      *bool     `json:"cooked"`
+	Archived    *bool     `json:"archived"`
+	Tags        *[]string `json:"tags"` // Replaces every tag
+}
+
+// EditResult tells the client what happened with one of its edits.
+type EditResult struct {
+	ID      uint           `json:"id"`
+	Status  string         `json:"status"`
+	Version int            `json:"version,omitempty"` // New version when applied
+	Server  *models.Recipe `json:"server,omitempty"`  // Current server copy on conflict
+	Error   string         `json:"error,omitempty"`
+}
+
+// ApplySyncEdits applies the offline edits in order. An edit based on an
+// older version than the server one is not applied: the client gets the
+// server copy to merge or discard its change.
+func ApplySyncEdits(edits []RecipeEdit) []EditResult {
+	results := make([]EditResult, 0, len(edits))
+	for _, edit := range edits {
+		results = append(results, applySyncEdit(edit))
+	}
+	return results
+}
+
+var errVersionConflict = errors.New("version conflict")
+
+func applySyncEdit(edit RecipeEdit) EditResult {
+	result := EditResult{ID: edit.ID}
+
+	var recipe models.Recipe
+	if err := database.DB.Preload("Ingredients").Preload("Steps").First(&recipe, edit.ID).Error; err != nil {
+		result.Status = EditNotFound
+		return result
+	}
+	if recipe.Version != edit.Version {
+		return conflictResult(result)
+	}
+
+	if edit.Deleted {
+		if err := DeleteRecipe(&recipe); err != nil {
+			result.Status = EditFailed
+			result.Error = err.Error()
+			return result
+		}
+		result.Status = EditApplied
+		return result
+	}
+
+	updates := map[string]interface{}{"version": NextVersion()}
+	if edit.Title != nil {
+		recipe.Title = *edit.Title
+		updates["title"] = recipe.Title
+	}
+	if edit.Description != nil {
+		recipe.Description = *edit.Description
+		updates["description"] = recipe.Description
+	}
+	if edit.CookingTime != nil {
+		updates["cooking_time"] = *edit.CookingTime
+	}
+	if edit.Cooked != nil {
+		updates["cooked"] = *edit.Cooked
+	}
+	if edit.Archived != nil {
+		updates["archived"] = *edit.Archived
+	}
+	servingsChanged := edit.Servings != nil && *edit.Servings != recipe.Servings
+	if servingsChanged {
+		recipe.Servings = *edit.Servings
+		updates["servings"] = recipe.Servings
+	}
+	recipe.UpdateSearchText()
+	updates["search_text"] = recipe.SearchText
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		// The version check is repeated in the update, in case the recipe changed meanwhile
+		res := tx.Model(&models.Recipe{}).Where("id = ? AND version = ?", recipe.ID, edit.Version).Updates(updates)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errVersionConflict
+		}
+
+		if edit.Tags != nil {
+			if err := tx.Unscoped().Where("recipe_id = ?", recipe.ID).Delete(&models.Tag{}).Error; err != nil {
+				return err
+			}
+			seen := make(map[string]bool)
+			for _, name := range *edit.Tags {
+				name = strings.TrimSpace(name)
+				if name == "" || seen[strings.ToLower(name)] {
+					continue
+				}
+				seen[strings.ToLower(name)] = true
+				if err := tx.Create(&models.Tag{RecipeID: recipe.ID, Name: name}).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errVersionConflict) {
+		return conflictResult(result)
+	}
+	if err != nil {
+		result.Status = EditFailed
+		result.Error = err.Error()
+		return result
+	}
+
+	// Nutrition is per serving
+	if servingsChanged {
+		ComputeNutrition(&recipe)
+		if err := SaveNutrition(&recipe); err != nil {
+			log.Printf("Failed to update nutrition of recipe %d: %v", recipe.ID, err)
+		}
+	}
+
+	database.DB.Model(&models.Recipe{}).Where("id = ?", recipe.ID).Select("version").Scan(&result.Version)
+	result.Status = EditApplied
+	return result
+}
+
+// conflictResult fills a conflict result with the server copy of the recipe.
+func conflictResult(result EditResult) EditResult {
+	result.Status = EditConflict
+	var server models.Recipe
+	err := database.DB.Preload("Ingredients", OrderByID).Preload("Steps", OrderByID).
+		Preload("Tags").Preload("AlternateSources").First(&server, result.ID).Error
+	if err != nil {
+		result.Status = EditNotFound
+		return result
+	}
+	result.Server = &server
+	result.Version = server.Version
+	return result
+}
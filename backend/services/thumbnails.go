@@ -0,0 +1,237 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"xgastroteca/database"
+	"xgastroteca/models"
+	"xgastroteca/storage"
+
+	"github.com/buckket/go-blurhash"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Thumbnail sizes used by the app: max width in pixels (never upscaled)
+var thumbnailSizes = []struct {
+	name  string
+	width int
+}{
+	{"card", 360},    // Recipe list cards
+	{"header", 1080}, // Detail screen header
+}
+
+const (
+	thumbnailJPEGQuality = 80
+	thumbnailWebPQuality = "75"
+	blurHashWidth        = 32 // Pixels of the image the BlurHash is computed from
+)
+
+// GenerateThumbnails writes the resized thumbnails (JPEG and WebP) and the
+// BlurHash placeholder of a recipe from its ThumbnailPath. The files are left
+// in the work directory as <thumbnail>_card_<hash>.jpg, <thumbnail>_header_<hash>.webp...
+// and published with the rest of the recipe media.
+func GenerateThumbnails(recipe *models.Recipe) error {
+	if recipe.ThumbnailPath == "" {
+		recipe.Thumbnails = models.ThumbnailSet{}
+		return nil
+	}
+
+	srcPath, cleanup, err := localMediaCopy(recipe.ThumbnailPath)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to decode thumbnail: %v", err)
+	}
+
+	set := models.ThumbnailSet{Source: recipe.ThumbnailPath}
+	base := strings.TrimSuffix(recipe.ThumbnailPath, path.Ext(recipe.ThumbnailPath))
+	for _, size := range thumbnailSizes {
+		resized := resizeImage(img, size.width)
+		data, err := encodeJPEG(resized)
+		if err != nil {
+			return err
+		}
+
+		// The content hash in the name lets clients cache the files forever
+		sum := sha256.Sum256(data)
+		name := fmt.Sprintf("%s_%s_%s", base, size.name, hex.EncodeToString(sum[:4]))
+		variant := models.ThumbnailVariant{
+			JPEG:   name + ".jpg",
+			Width:  resized.Bounds().Dx(),
+			Height: resized.Bounds().Dy(),
+		}
+		if err := os.WriteFile(storage.WorkPath(variant.JPEG), data, 0644); err != nil {
+			return fmt.Errorf("failed to write thumbnail: %v", err)
+		}
+
+		// WebP needs ffmpeg built with libwebp; JPEG alone is still usable
+		webpKey := name + ".webp"
+		if err := encodeWebP(storage.WorkPath(variant.JPEG), storage.WorkPath(webpKey)); err != nil {
+			log.Printf("WebP thumbnail skipped: %v", err)
+		} else {
+			variant.WebP = webpKey
+		}
+
+		switch size.name {
+		case "card":
+			set.Card = variant
+		case "header":
+			set.Header = variant
+		}
+	}
+
+	// Few components, the placeholder is only a blurred color layout
+	hash, err := blurhash.Encode(4, 3, resizeImage(img, blurHashWidth))
+	if err != nil {
+		log.Printf("Failed to compute BlurHash: %v", err)
+	}
+	set.BlurHash = hash
+
+	recipe.Thumbnails = set
+	return nil
+}
+
+// resizeImage scales an image down to maxWidth keeping its aspect ratio.
+func resizeImage(img image.Image, maxWidth int) image.Image {
+	b := img.Bounds()
+	if b.Dx() <= maxWidth {
+		return img
+	}
+	height := max(b.Dy()*maxWidth/b.Dx(), 1)
+	dst := image.NewRGBA(image.Rect(0, 0, maxWidth, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst
+}
+
+func encodeJPEG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: thumbnailJPEGQuality}); err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeWebP converts an image with ffmpeg (libwebp).
+func encodeWebP(inPath, outPath string) error {
+	err := runFFmpeg(time.Minute, "-y", "-i", inPath, "-c:v", "libwebp", "-quality", thumbnailWebPQuality, outPath)
+	if err != nil {
+		os.Remove(outPath)
+	}
+	return err
+}
+
+// localMediaCopy returns a local file with the content of a key: the work
+// copy when the pipeline still has it, otherwise a temporary download from
+// the store. cleanup removes the temporary file.
+func localMediaCopy(key string) (string, func(), error) {
+	noop := func() {}
+	if _, err := os.Stat(storage.WorkPath(key)); err == nil {
+		return storage.WorkPath(key), noop, nil
+	}
+	if p, ok := storage.LocalPath(storage.Media, key); ok {
+		return p, noop, nil
+	}
+
+	body, err := storage.Media.Get(context.Background(), key)
+	if err != nil {
+		return "", noop, fmt.Errorf("failed to read %s: %v", key, err)
+	}
+	defer body.Close()
+
+	tmp, err := os.CreateTemp("", "media_*"+path.Ext(key))
+	if err != nil {
+		return "", noop, err
+	}
+	_, err = io.Copy(tmp, body)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", noop, fmt.Errorf("failed to download %s: %v", key, err)
+	}
+	return tmp.Name(), func() { os.Remove(tmp.Name()) }, nil
+}
+
+// RegenerateThumbnails rebuilds the thumbnails of a saved recipe, stores them
+// and removes the previous ones when nothing else uses them.
+func RegenerateThumbnails(recipe *models.Recipe) error {
+	oldKeys := thumbnailVariantKeys(recipe)
+
+	if err := GenerateThumbnails(recipe); err != nil {
+		return err
+	}
+	newKeys := thumbnailVariantKeys(recipe)
+	if err := publishWorkFiles(newKeys); err != nil {
+		return err
+	}
+
+	err := database.DB.Model(recipe).Updates(map[string]interface{}{
+		"thumbnails_card_jpeg":     recipe.Thumbnails.Card.JPEG,
+		"thumbnails_card_webp":     recipe.Thumbnails.Card.WebP,
+		"thumbnails_card_width":    recipe.Thumbnails.Card.Width,
+		"thumbnails_card_height":   recipe.Thumbnails.Card.Height,
+		"thumbnails_header_jpeg":   recipe.Thumbnails.Header.JPEG,
+		"thumbnails_header_webp":   recipe.Thumbnails.Header.WebP,
+		"thumbnails_header_width":  recipe.Thumbnails.Header.Width,
+		"thumbnails_header_height": recipe.Thumbnails.Header.Height,
+		"thumbnails_blur_hash":     recipe.Thumbnails.BlurHash,
+		"thumbnails_source":        recipe.Thumbnails.Source,
+		"version":                  NextVersion(),
+	}).Error
+	if err != nil {
+		return fmt.Errorf("failed to save thumbnails: %v", err)
+	}
+
+	for _, key := range oldKeys {
+		if !containsString(newKeys, key) && !MediaReferenced(key, recipe.ID) {
+			storage.Media.Delete(context.Background(), key)
+		}
+	}
+	return nil
+}
+
+// GeneratePendingThumbnails creates the thumbnails of recipes saved before
+// they existed, or whose thumbnail changed since (all regenerates every recipe).
+// Returns the number of recipes updated.
+func GeneratePendingThumbnails(all bool) int {
+	var recipes []models.Recipe
+	query := database.DB.Where("thumbnail_path != ''")
+	if !all {
+		query = query.Where("thumbnails_source IS NULL OR thumbnails_source != thumbnail_path")
+	}
+	query.Find(&recipes)
+
+	updated := 0
+	for i := range recipes {
+		if err := RegenerateThumbnails(&recipes[i]); err != nil {
+			log.Printf("Failed to generate thumbnails for recipe %d: %v", recipes[i].ID, err)
+			continue
+		}
+		updated++
+	}
+	if updated > 0 {
+		log.Printf("Generated thumbnails for %d recipes", updated)
+	}
+	return updated
+}
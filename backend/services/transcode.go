@@ -0,0 +1,220 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Transcoding modes (TRANSCODE_MODE)
+const (
+	TranscodeAuto   = "auto"   // Only videos that aren't H.264/AAC or exceed the max height
+	TranscodeAlways = "always" // Every video, to get a predictable bitrate
+	TranscodeOff    = "off"
+)
+
+const defaultTranscodeTimeout = 30 * time.Minute
+
+// TranscodeSettings controls the mobile friendly rendition of the videos.
+type TranscodeSettings struct {
+	Mode         string
+	MaxHeight    int    // Pixels, e.g. 720
+	VideoBitrate string // ffmpeg syntax, e.g. "2000k"
+	AudioBitrate string // e.g. "128k"
+	HLS          bool   // Also write HLS segments for streaming
+	KeepOriginal bool   // Keep the downloaded file next to the rendition
+	Timeout      time.Duration
+}
+
+// Rendition is the result of preparing a video for playback.
+type Rendition struct {
+	VideoPath  string // Playable MP4 (the original when no transcoding was needed)
+	HLSPath    string // <dir>/index.m3u8, empty when HLS is disabled or failed
+	Transcoded bool
+}
+
+// TranscodeSettingsFromEnv reads the transcoding settings from the environment.
+func TranscodeSettingsFromEnv() TranscodeSettings {
+	s := TranscodeSettings{
+		Mode:         os.Getenv("TRANSCODE_MODE"),
+		MaxHeight:    720,
+		VideoBitrate: os.Getenv("TRANSCODE_VIDEO_BITRATE"),
+		AudioBitrate: os.Getenv("TRANSCODE_AUDIO_BITRATE"),
+		HLS:          os.Getenv("TRANSCODE_HLS") == "true",
+		KeepOriginal: os.Getenv("TRANSCODE_KEEP_ORIGINAL") == "true",
+		Timeout:      defaultTranscodeTimeout,
+	}
+	if s.Mode != TranscodeAlways && s.Mode != TranscodeOff {
+		s.Mode = TranscodeAuto
+	}
+	if h, err := strconv.Atoi(os.Getenv("TRANSCODE_MAX_HEIGHT")); err == nil && h > 0 {
+		s.MaxHeight = h
+	}
+	if s.VideoBitrate == "" {
+		s.VideoBitrate = "2000k"
+	}
+	if s.AudioBitrate == "" {
+		s.AudioBitrate = "128k"
+	}
+	if secs, err := strconv.Atoi(os.Getenv("TRANSCODE_TIMEOUT")); err == nil && secs > 0 {
+		s.Timeout = time.Duration(secs) * time.Second
+	}
+	return s
+}
+
+// videoStreams is the part of the ffprobe output we need.
+type videoStreams struct {
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		CodecName string `json:"codec_name"`
+		Height    int    `json:"height"`
+		PixFmt    string `json:"pix_fmt"`
+	} `json:"streams"`
+}
+
+// needsTranscode reports whether a video can't be played smoothly by older
+// phones: codecs other than H.264/AAC, 10-bit color or a too large resolution.
+func needsTranscode(videoPath string, maxHeight int) (bool, error) {
+	out, err := exec.Command("ffprobe",
+		"-v", "error",
+		"-show_entries", "stream=codec_type,codec_name,height,pix_fmt",
+		"-of", "json",
+		videoPath,
+	).Output()
+	if err != nil {
+		return false, fmt.Errorf("ffprobe failed: %v", err)
+	}
+
+	var probe videoStreams
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return false, fmt.Errorf("invalid ffprobe output: %v", err)
+	}
+
+	for _, s := range probe.Streams {
+		switch s.CodecType {
+		case "video":
+			if s.CodecName != "h264" || s.PixFmt != "yuv420p" || s.Height > maxHeight {
+				return true, nil
+			}
+		case "audio":
+			if s.CodecName != "aac" {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// TranscodeVideo prepares a video for playback on phones: an H.264/AAC MP4
+// (<base>_h264.mp4) capped at the configured height and bitrate and, when
+// enabled, HLS segments in <base>_hls/. The original file is not touched.
+func TranscodeVideo(videoPath string, s TranscodeSettings) (*Rendition, error) {
+	rendition := &Rendition{VideoPath: videoPath}
+	if s.Mode == TranscodeOff {
+		return rendition, nil
+	}
+
+	base := strings.TrimSuffix(videoPath, filepath.Ext(videoPath))
+
+	needed := s.Mode == TranscodeAlways
+	if !needed {
+		var err error
+		needed, err = needsTranscode(videoPath, s.MaxHeight)
+		if err != nil {
+			return rendition, err
+		}
+	}
+
+	if needed {
+		outPath := base + "_h264.mp4"
+		log.Printf("Transcoding %s to H.264/AAC (max %dp)", filepath.Base(videoPath), s.MaxHeight)
+
+		err := runFFmpeg(s.Timeout,
+			"-y",
+			"-i", videoPath,
+			"-map", "0:v:0",
+			"-map", "0:a:0?",
+			"-c:v", "libx264",
+			"-preset", "veryfast",
+			"-profile:v", "main",
+			"-pix_fmt", "yuv420p",
+			"-vf", fmt.Sprintf("scale=-2:'min(%d,ih)'", s.MaxHeight),
+			"-b:v", s.VideoBitrate,
+			"-maxrate", s.VideoBitrate,
+			"-bufsize", doubleBitrate(s.VideoBitrate),
+			"-g", "60", // Regular keyframes, so HLS segments have a steady length
+			"-c:a", "aac",
+			"-b:a", s.AudioBitrate,
+			"-ac", "2",
+			"-movflags", "+faststart",
+			outPath,
+		)
+		if err != nil {
+			os.Remove(outPath)
+			return rendition, err
+		}
+		rendition.VideoPath = outPath
+		rendition.Transcoded = true
+	}
+
+	if s.HLS {
+		hlsDir := base + "_hls"
+		playlist := filepath.Join(hlsDir, "index.m3u8")
+		if err := os.MkdirAll(hlsDir, 0755); err != nil {
+			log.Printf("Failed to create HLS directory: %v", err)
+			return rendition, nil
+		}
+
+		err := runFFmpeg(s.Timeout,
+			"-y",
+			"-i", rendition.VideoPath,
+			"-c", "copy",
+			"-f", "hls",
+			"-hls_time", "6",
+			"-hls_playlist_type", "vod",
+			"-hls_segment_filename", filepath.Join(hlsDir, "segment_%03d.ts"),
+			playlist,
+		)
+		if err != nil {
+			// HLS is optional, the MP4 rendition is still playable
+			log.Printf("HLS segmentation failed: %v", err)
+			os.RemoveAll(hlsDir)
+		} else {
+			rendition.HLSPath = playlist
+		}
+	}
+
+	return rendition, nil
+}
+
+// runFFmpeg runs ffmpeg with a timeout and returns its last output line on failure.
+func runFFmpeg(timeout time.Duration, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, "ffmpeg", append([]string{"-v", "error"}, args...)...).CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("ffmpeg timed out after %s", timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("ffmpeg failed: %v: %s", err, lastLine(out))
+	}
+	return nil
+}
+
+// doubleBitrate returns twice an ffmpeg bitrate ("2000k" -> "4000k"), used as buffer size.
+func doubleBitrate(bitrate string) string {
+	number := strings.TrimRight(bitrate, "kKmM")
+	value, err := strconv.Atoi(number)
+	if err != nil {
+		return bitrate
+	}
+	return strconv.Itoa(value*2) + bitrate[len(number):]
+}
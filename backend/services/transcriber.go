@@ -0,0 +1,101 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Transcriber converts an audio file into plain text.
+type Transcriber interface {
+	Transcribe(audioPath string) (string, error)
+}
+
+// WhisperCppTranscriber runs a local whisper.cpp binary.
+type WhisperCppTranscriber struct {
+	BinaryPath string // e.g. whisper-cli
+	ModelPath  string // e.g. ./models/ggml-base.bin
+	Language   string // ISO code or "auto"
+}
+
+// NewTranscriber builds the default transcriber from the environment.
+// It returns nil when WHISPER_MODEL is not configured, meaning the
+// pipeline should skip transcription.
+func NewTranscriber() Transcriber {
+	model := os.Getenv("WHISPER_MODEL")
+	if model == "" {
+		return nil
+	}
+
+	bin := os.Getenv("WHISPER_BIN")
+	if bin == "" {
+		bin = "whisper-cli"
+	}
+
+	lang := os.Getenv("WHISPER_LANGUAGE")
+	if lang == "" {
+		lang = "auto"
+	}
+
+	return &WhisperCppTranscriber{
+		BinaryPath: bin,
+		ModelPath:  model,
+		Language:   lang,
+	}
+}
+
+// Transcribe runs whisper.cpp on a 16 kHz WAV file and returns the text.
+func (w *WhisperCppTranscriber) Transcribe(audioPath string) (string, error) {
+	// whisper.cpp appends ".txt" to the output base name
+	outBase := strings.TrimSuffix(audioPath, ".wav")
+	outFile := outBase + ".txt"
+	defer os.Remove(outFile)
+
+	cmd := exec.Command(w.BinaryPath,
+		"-m", w.ModelPath,
+		"-f", audioPath,
+		"-l", w.Language,
+		"-nt",
+		"-otxt",
+		"-of", outBase,
+	)
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("whisper failed: %v (%s)", err, lastLine(out))
+	}
+
+	data, err := os.ReadFile(outFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read transcript: %v", err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// TranscribeVideo extracts the audio of a video and transcribes it.
+// Errors are logged and an empty transcript is returned, so a missing
+// ffmpeg/whisper install never blocks recipe extraction.
+func TranscribeVideo(videoPath string) string {
+	transcriber := NewTranscriber()
+	if transcriber == nil {
+		return ""
+	}
+
+	audioPath, err := ExtractAudio(videoPath)
+	if err != nil {
+		log.Printf("Skipping transcription: %v", err)
+		return ""
+	}
+	defer os.Remove(audioPath)
+
+	transcript, err := transcriber.Transcribe(audioPath)
+	if err != nil {
+		log.Printf("Skipping transcription: %v", err)
+		return ""
+	}
+
+	log.Printf("Transcript obtained (%d chars)", len(transcript))
+	return transcript
+}
@@ -0,0 +1,233 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"xgastroteca/database"
+	"xgastroteca/models"
+	"xgastroteca/utils"
+)
+
+// Language names used in the translation prompt
+var languageNames = map[string]string{
+	"es": "español",
+	"en": "inglés",
+	"it": "italiano",
+	"pt": "portugués",
+	"fr": "francés",
+	"de": "alemán",
+	"ca": "catalán",
+}
+
+// translationDTO is the JSON exchanged with the AI to translate a recipe.
+type translationDTO struct {
+	Title       string                 `json:"title"`
+	Description string                 `json:"description"`
+	CookingTime string                 `json:"cooking_time"`
+	Ingredients []models.IngredientDTO `json:"ingredients"`
+	Steps       []string               `json:"steps"`
+}
+
+// RecipeLanguage returns the stored language of a recipe or detects it from the text.
+func RecipeLanguage(recipe *models.Recipe) string {
+	if recipe.Language != "" {
+		return recipe.Language
+	}
+	text := recipe.Title + " " + recipe.Description
+	for _, s := range recipe.Steps {
+		text += " " + s.Text
+	}
+	return utils.DetectLanguage(text)
+}
+
+// translationSource returns the texts of a recipe to translate (ingredients
+// and steps loaded in order) and their hash.
+func translationSource(recipe *models.Recipe) (translationDTO, string) {
+	source := translationDTO{
+		Title:       recipe.Title,
+		Description: recipe.Description,
+		CookingTime: recipe.CookingTime,
+		Ingredients: []models.IngredientDTO{},
+		Steps:       []string{},
+	}
+	for _, ing := range recipe.Ingredients {
+		source.Ingredients = append(source.Ingredients, models.IngredientDTO{Item: ing.Item, Quantity: ing.Quantity})
+	}
+	for _, s := range recipe.Steps {
+		source.Steps = append(source.Steps, s.Text)
+	}
+	sourceJSON, _ := json.Marshal(source)
+	sum := sha256.Sum256(sourceJSON)
+	return source, hex.EncodeToString(sum[:])
+}
+
+// FindTranslation returns the cached translation of a recipe (with ingredients
+// and steps loaded in order), if any and made from its current texts.
+func FindTranslation(recipe *models.Recipe, lang string) *models.RecipeTranslation {
+	t := findTranslationRow(recipe.ID, lang)
+	if t == nil {
+		return nil
+	}
+	if _, hash := translationSource(recipe); t.SourceHash != hash {
+		return nil
+	}
+	return t
+}
+
+// findTranslationRow returns the stored translation, outdated or not.
+func findTranslationRow(recipeID uint, lang string) *models.RecipeTranslation {
+	var t models.RecipeTranslation
+	if err := database.DB.Where("recipe_id = ? AND language = ?", recipeID, languageCode(lang)).First(&t).Error; err != nil {
+		return nil
+	}
+	return &t
+}
+
+// AvailableTranslations lists the languages with an up to date cached translation
+// (the recipe must have its ingredients and steps loaded in order).
+func AvailableTranslations(recipe *models.Recipe) []string {
+	_, hash := translationSource(recipe)
+	langs := []string{}
+	database.DB.Model(&models.RecipeTranslation{}).Where("recipe_id = ? AND source_hash = ?", recipe.ID, hash).
+		Order("language").Pluck("language", &langs)
+	return langs
+}
+
+// TranslateRecipe translates a recipe (with ingredients and steps loaded in order)
+// through the AI provider and caches the result. Cached translations are reused
+// unless refresh is true.
+func TranslateRecipe(recipe *models.Recipe, lang string, refresh bool) (*models.RecipeTranslation, error) {
+	lang = languageCode(lang)
+	source, sourceHash := translationSource(recipe)
+	existing := findTranslationRow(recipe.ID, lang)
+	if existing != nil && existing.SourceHash == sourceHash && !refresh {
+		return existing, nil
+	}
+	sourceJSON, _ := json.Marshal(source)
+
+	langName := languageNames[lang]
+	if langName == "" {
+		langName = lang
+	}
+
+	prompt := fmt.Sprintf("Traduce al %s (código %s) la siguiente receta en JSON. Mantén exactamente la misma estructura, el mismo número y orden de ingredientes y pasos, y convierte solo el texto (no cambies cantidades ni unidades). Responde SOLO con el JSON traducido, sin bloques de código markdown.\n\n%s", langName, lang, sourceJSON)
+
+	jsonText, _, err := generateText("translate_recipe", prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	var dto translationDTO
+	if err := json.Unmarshal([]byte(jsonText), &dto); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON response: %v \nRaw text: %s", err, jsonText)
+	}
+	if len(dto.Ingredients) != len(source.Ingredients) || len(dto.Steps) != len(source.Steps) {
+		return nil, fmt.Errorf("translation does not match the original structure")
+	}
+
+	ingredientsJSON, _ := json.Marshal(dto.Ingredients)
+	stepsJSON, _ := json.Marshal(dto.Steps)
+
+	t := existing
+	if t == nil {
+		t = &models.RecipeTranslation{RecipeID: recipe.ID, Language: lang}
+	}
+	t.Title = dto.Title
+	t.Description = dto.Description
+	t.CookingTime = dto.CookingTime
+	t.Ingredients = string(ingredientsJSON)
+	t.Steps = string(stepsJSON)
+	t.SourceHash = sourceHash
+
+	if err := database.DB.Save(t).Error; err != nil {
+		return nil, fmt.Errorf("failed to save translation: %v", err)
+	}
+
+	log.Printf("Recipe %d translated to %s", recipe.ID, lang)
+	return t, nil
+}
+
+// ApplyTranslation replaces the texts of a recipe with a translation.
+// The recipe must have its ingredients and steps loaded in order.
+func ApplyTranslation(recipe *models.Recipe, t *models.RecipeTranslation) {
+	recipe.Title = t.Title
+	recipe.Description = t.Description
+	if t.CookingTime != "" {
+		recipe.CookingTime = t.CookingTime
+	}
+	recipe.Language = t.Language
+
+	var ingredients []models.IngredientDTO
+	if err := json.Unmarshal([]byte(t.Ingredients), &ingredients); err == nil && len(ingredients) == len(recipe.Ingredients) {
+		for i := range recipe.Ingredients {
+			recipe.Ingredients[i].Item = ingredients[i].Item
+			recipe.Ingredients[i].Quantity = ingredients[i].Quantity
+		}
+	}
+
+	var steps []string
+	if err := json.Unmarshal([]byte(t.Steps), &steps); err == nil && len(steps) == len(recipe.Steps) {
+		for i := range recipe.Steps {
+			recipe.Steps[i].Text = steps[i]
+		}
+	}
+}
+
+// LocalizeRecipe picks the first preferred language available for the recipe
+// (the original or a cached translation), applies it and returns its code.
+func LocalizeRecipe(recipe *models.Recipe, preferred []string) string {
+	original := RecipeLanguage(recipe)
+	for _, lang := range preferred {
+		if lang == original {
+			break
+		}
+		if t := FindTranslation(recipe, lang); t != nil {
+			ApplyTranslation(recipe, t)
+			return lang
+		}
+	}
+	recipe.Language = original
+	return original
+}
+
+// DetectPendingLanguages stores the detected language of recipes created before
+// it was tracked, and reduces the tags stored as reported by the AI ("es-ES").
+func DetectPendingLanguages() {
+	var tagged []models.Recipe
+	database.DB.Select("id", "language").Where("length(language) > 2 OR language <> lower(language)").Find(&tagged)
+	for _, r := range tagged {
+		database.DB.Model(&models.Recipe{}).Where("id = ?", r.ID).UpdateColumn("language", languageCode(r.Language))
+	}
+
+	var recipes []models.Recipe
+	database.DB.Preload("Steps").Where("language = '' OR language IS NULL").Find(&recipes)
+	for i := range recipes {
+		if lang := RecipeLanguage(&recipes[i]); lang != "" {
+			database.DB.Model(&models.Recipe{}).Where("id = ?", recipes[i].ID).Update("language", lang)
+		}
+	}
+}
+
+// AdoptLegacyTranslations marks the translations cached before they recorded
+// their source hash as made from the current texts of the recipe.
+func AdoptLegacyTranslations() {
+	var recipeIDs []uint
+	database.DB.Model(&models.RecipeTranslation{}).Where("source_hash = '' OR source_hash IS NULL").
+		Distinct().Pluck("recipe_id", &recipeIDs)
+	for _, id := range recipeIDs {
+		var recipe models.Recipe
+		err := database.DB.Preload("Ingredients", OrderByID).Preload("Steps", OrderByID).First(&recipe, id).Error
+		if err != nil {
+			continue
+		}
+		_, hash := translationSource(&recipe)
+		err = database.DB.Model(&models.RecipeTranslation{}).
+			Where("recipe_id = ? AND (source_hash = '' OR source_hash IS NULL)", id).Update("source_hash", hash).Error
+		if err != nil {
+			log.Printf("Failed to update legacy translations of recipe %d: %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"xgastroteca/database"
+	"xgastroteca/models"
+	"xgastroteca/storage"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// Local working directories, under storage.WorkDir
+var (
+	uploadsPath = storage.WorkPath("uploads")
+	videosPath  = storage.WorkPath("videos")
+)
+
+const (
+	defaultUploadMaxMB = 500
+	uploadSessionTTL   = 24 * time.Hour
+	uploadCleanupEvery = time.Hour
+
+	// UploadChunkSize is the recommended chunk size for resumable uploads.
+	UploadChunkSize = 8 << 20
+
+	// Queue jobs for uploaded files use this prefix instead of a URL
+	uploadJobScheme = "upload://"
+)
+
+// Accepted video types and the extension used to store them
+var allowedVideoTypes = map[string]string{
+	"video/mp4":        ".mp4",
+	"video/quicktime":  ".mov",
+	"video/webm":       ".webm",
+	"video/x-matroska": ".mkv",
+	"video/3gpp":       ".3gp",
+}
+
+// Upload errors, mapped to HTTP status codes by the handlers
+var (
+	ErrUploadTooLarge      = fmt.Errorf("file exceeds the maximum upload size")
+	ErrUploadType          = fmt.Errorf("file type not allowed, upload a video (mp4, mov, webm, mkv, 3gp)")
+	ErrUploadOffset        = fmt.Errorf("upload offset mismatch")
+	ErrUploadIncomplete    = fmt.Errorf("upload is not complete")
+	ErrUploadSessionClosed = fmt.Errorf("upload session not found")
+)
+
+// UploadMaxBytes returns the maximum accepted upload size (UPLOAD_MAX_MB).
+func UploadMaxBytes() int64 {
+	mb, err := strconv.ParseInt(os.Getenv("UPLOAD_MAX_MB"), 10, 64)
+	if err != nil || mb <= 0 {
+		mb = defaultUploadMaxMB
+	}
+	return mb << 20
+}
+
+// UploadJobURL is the queue job URL of an uploaded file waiting for analysis.
+func UploadJobURL(fullPath string) string {
+	return uploadJobScheme + fullPath
+}
+
+// CreateUploadSession starts a resumable upload.
+func CreateUploadSession(filename, mimeType string, size int64) (*models.UploadSession, error) {
+	if size <= 0 || size > UploadMaxBytes() {
+		return nil, ErrUploadTooLarge
+	}
+	if _, ok := allowedVideoTypes[mimeType]; !ok {
+		return nil, ErrUploadType
+	}
+
+	if err := os.MkdirAll(uploadsPath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create uploads directory: %v", err)
+	}
+
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+
+	session := &models.UploadSession{
+		UploadID: id,
+		Filename: filepath.Base(filename),
+		MimeType: mimeType,
+		Size:     size,
+		TempPath: filepath.Join(uploadsPath, id+".part"),
+	}
+
+	f, err := os.Create(session.TempPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload file: %v", err)
+	}
+	f.Close()
+
+	if err := database.DB.Create(session).Error; err != nil {
+		os.Remove(session.TempPath)
+		return nil, fmt.Errorf("failed to save upload session: %v", err)
+	}
+	return session, nil
+}
+
+// FindUploadSession returns an upload session by its public ID.
+func FindUploadSession(uploadID string) (*models.UploadSession, error) {
+	var session models.UploadSession
+	if err := database.DB.Where("upload_id = ?", uploadID).First(&session).Error; err != nil {
+		return nil, ErrUploadSessionClosed
+	}
+	return &session, nil
+}
+
+// One lock per upload ID, so concurrent requests for a session take turns
+var uploadLocks sync.Map
+
+func lockUpload(uploadID string) func() {
+	mu, _ := uploadLocks.LoadOrStore(uploadID, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// AppendUploadChunk writes a chunk at the given offset, which must be the
+// number of bytes already received. Returns the new offset.
+func AppendUploadChunk(session *models.UploadSession, offset int64, chunk io.Reader) (int64, error) {
+	unlock := lockUpload(session.UploadID)
+	defer unlock()
+
+	// Another request may have written a chunk since the session was loaded
+	if err := database.DB.First(session, session.ID).Error; err != nil {
+		return 0, ErrUploadSessionClosed
+	}
+	if offset != session.Offset {
+		return session.Offset, ErrUploadOffset
+	}
+
+	f, err := os.OpenFile(session.TempPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return session.Offset, fmt.Errorf("failed to open upload file: %v", err)
+	}
+	defer f.Close()
+
+	// Read at most one byte more than what is left, to detect oversized uploads
+	remaining := session.Size - session.Offset
+	written, err := io.Copy(f, io.LimitReader(chunk, remaining+1))
+	if written > remaining {
+		f.Truncate(session.Size)
+		written = remaining
+		err = ErrUploadTooLarge
+	}
+
+	// Keep whatever was written, so the client can resume after a network error
+	session.Offset += written
+	database.DB.Model(session).Update("offset", session.Offset)
+
+	if err != nil {
+		return session.Offset, err
+	}
+	return session.Offset, nil
+}
+
+// FinishUpload validates a fully received upload and moves it to the videos
+// directory. Returns the final path of the video.
+func FinishUpload(session *models.UploadSession) (string, error) {
+	unlock := lockUpload(session.UploadID)
+	defer unlock()
+
+	if err := database.DB.First(session, session.ID).Error; err != nil {
+		return "", ErrUploadSessionClosed
+	}
+	if session.Offset != session.Size {
+		return "", ErrUploadIncomplete
+	}
+
+	// The temporary file is gone either way, so the session is closed too
+	finalPath, err := storeVideo(session.TempPath)
+	database.DB.Unscoped().Delete(session)
+	uploadLocks.Delete(session.UploadID)
+	if err != nil {
+		return "", err
+	}
+	return finalPath, nil
+}
+
+// SaveUploadedFile stores a video sent in a single multipart request.
+func SaveUploadedFile(header *multipart.FileHeader) (string, error) {
+	if header.Size > UploadMaxBytes() {
+		return "", ErrUploadTooLarge
+	}
+
+	if err := os.MkdirAll(uploadsPath, 0755); err != nil {
+		return "", fmt.Errorf("failed to create uploads directory: %v", err)
+	}
+
+	src, err := header.Open()
+	if err != nil {
+		return "", fmt.Errorf("failed to read upload: %v", err)
+	}
+	defer src.Close()
+
+	id, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	tempPath := filepath.Join(uploadsPath, id+".part")
+
+	dst, err := os.Create(tempPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create upload file: %v", err)
+	}
+	_, err = io.Copy(dst, src)
+	dst.Close()
+	if err != nil {
+		os.Remove(tempPath)
+		return "", fmt.Errorf("failed to save upload: %v", err)
+	}
+
+	return storeVideo(tempPath)
+}
+
+// storeVideo checks the real type of an uploaded file (not the one declared
+// by the client) and moves it to the videos directory.
+func storeVideo(tempPath string) (string, error) {
+	mtype, err := mimetype.DetectFile(tempPath)
+	if err != nil {
+		os.Remove(tempPath)
+		return "", fmt.Errorf("failed to detect file type: %v", err)
+	}
+
+	ext := ""
+	for allowed, e := range allowedVideoTypes {
+		if mtype.Is(allowed) {
+			ext = e
+			break
+		}
+	}
+	if ext == "" {
+		log.Printf("Rejected upload of type %s", mtype.String())
+		os.Remove(tempPath)
+		return "", ErrUploadType
+	}
+
+	finalPath := filepath.Join(videosPath, fmt.Sprintf("video_%d%s", time.Now().UnixNano(), ext))
+	if err := os.Rename(tempPath, finalPath); err != nil {
+		os.Remove(tempPath)
+		return "", fmt.Errorf("failed to store video: %v", err)
+	}
+	return finalPath, nil
+}
+
+// CleanupStaleUploads removes resumable uploads not completed within a day.
+func CleanupStaleUploads() {
+	cutoff := time.Now().Add(-uploadSessionTTL)
+	var sessions []models.UploadSession
+	database.DB.Where("updated_at < ?", cutoff).Find(&sessions)
+	removed := 0
+	for _, s := range sessions {
+		unlock := lockUpload(s.UploadID)
+		// Skip the session if a chunk arrived since it was loaded
+		res := database.DB.Unscoped().Where("updated_at < ?", cutoff).Delete(&s)
+		if res.Error == nil && res.RowsAffected > 0 {
+			os.Remove(s.TempPath)
+			removed++
+		}
+		unlock()
+		uploadLocks.Delete(s.UploadID)
+	}
+	if removed > 0 {
+		log.Printf("Removed %d stale uploads", removed)
+	}
+}
+
+// StartUploadCleaner removes the stale uploads now and then every hour.
+func StartUploadCleaner() {
+	CleanupStaleUploads()
+
+	go func() {
+		ticker := time.NewTicker(uploadCleanupEvery)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			CleanupStaleUploads()
+		}
+	}()
+}
+
+// IsUploadJob reports whether a queue job URL refers to an uploaded file.
+func IsUploadJob(url string) bool {
+	return strings.HasPrefix(url, uploadJobScheme)
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate upload id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
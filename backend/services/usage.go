@@ -0,0 +1,136 @@
+package services
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"xgastroteca/database"
+	"xgastroteca/models"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+const defaultGeminiModel = "gemini-2.5-flash"
+
+// modelPrices are USD per million tokens (input, output).
+// Can be overridden with GEMINI_PRICE_INPUT / GEMINI_PRICE_OUTPUT.
+var modelPrices = map[string][2]float64{
+	"gemini-2.5-flash":      {0.30, 2.50},
+	"gemini-2.5-flash-lite": {0.10, 0.40},
+	"gemini-2.5-pro":        {1.25, 10.00},
+	"gemini-1.5-flash":      {0.075, 0.30},
+}
+
+// GeminiModelName returns the model used for every Gemini call (GEMINI_MODEL).
+func GeminiModelName() string {
+	if m := os.Getenv("GEMINI_MODEL"); m != "" {
+		return m
+	}
+	return defaultGeminiModel
+}
+
+// recordAIUsage stores the token usage of a GenerateContent response and
+// returns it so it can be attached to the recipe.
+func recordAIUsage(purpose string, modelName string, resp *genai.GenerateContentResponse) models.TokenUsage {
+	usage := models.TokenUsage{Model: modelName}
+	if resp == nil || resp.UsageMetadata == nil {
+		return usage
+	}
+
+	usage.PromptTokens = int(resp.UsageMetadata.PromptTokenCount)
+	usage.ResponseTokens = int(resp.UsageMetadata.CandidatesTokenCount)
+
+	record := models.AIUsageRecord{
+		Purpose:        purpose,
+		AIModel:        modelName,
+		PromptTokens:   usage.PromptTokens,
+		ResponseTokens: usage.ResponseTokens,
+		TotalTokens:    int(resp.UsageMetadata.TotalTokenCount),
+	}
+	if err := database.DB.Create(&record).Error; err != nil {
+		log.Printf("Failed to record AI usage: %v", err)
+	}
+
+	log.Printf("AI usage (%s, %s): prompt=%d response=%d", purpose, modelName, usage.PromptTokens, usage.ResponseTokens)
+	return usage
+}
+
+// EstimateCost returns the approximate price in USD of the given token counts.
+func EstimateCost(modelName string, promptTokens, responseTokens int) float64 {
+	prices, ok := modelPrices[modelName]
+	if !ok {
+		prices = modelPrices[defaultGeminiModel]
+	}
+	if v, err := strconv.ParseFloat(os.Getenv("GEMINI_PRICE_INPUT"), 64); err == nil {
+		prices[0] = v
+	}
+	if v, err := strconv.ParseFloat(os.Getenv("GEMINI_PRICE_OUTPUT"), 64); err == nil {
+		prices[1] = v
+	}
+	return (float64(promptTokens)*prices[0] + float64(responseTokens)*prices[1]) / 1e6
+}
+
+// DailyAIUsage is the aggregated usage of one model on one day.
+type DailyAIUsage struct {
+	Date           string  `json:"date"`
+	Model          string  `json:"model"`
+	Requests       int     `json:"requests"`
+	PromptTokens   int     `json:"prompt_tokens"`
+	ResponseTokens int     `json:"response_tokens"`
+	TotalTokens    int     `json:"total_tokens"`
+	EstimatedCost  float64 `json:"estimated_cost_usd"`
+}
+
+// AIUsageStats aggregates the recorded AI calls of the last N days per day and model.
+func AIUsageStats(days int) ([]DailyAIUsage, error) {
+	since := time.Now().AddDate(0, 0, -days)
+
+	var rows []DailyAIUsage
+	err := database.DB.Model(&models.AIUsageRecord{}).
+		Select("date(created_at) AS date, ai_model AS model, COUNT(*) AS requests, "+
+			"SUM(prompt_tokens) AS prompt_tokens, SUM(response_tokens) AS response_tokens, SUM(total_tokens) AS total_tokens").
+		Where("created_at >= ?", since).
+		Group("date(created_at), ai_model").
+		Order("date desc, model").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range rows {
+		rows[i].EstimatedCost = EstimateCost(rows[i].Model, rows[i].PromptTokens, rows[i].ResponseTokens)
+	}
+	return rows, nil
+}
+
+// QuotaStatus compares today's usage with the configured daily limits
+// (GEMINI_DAILY_REQUEST_LIMIT, GEMINI_DAILY_TOKEN_LIMIT). Limits of 0 are unknown.
+func QuotaStatus(stats []DailyAIUsage) map[string]interface{} {
+	today := time.Now().UTC().Format("2006-01-02")
+	requests, tokens := 0, 0
+	for _, s := range stats {
+		if strings.HasPrefix(s.Date, today) {
+			requests += s.Requests
+			tokens += s.TotalTokens
+		}
+	}
+
+	requestLimit, _ := strconv.Atoi(os.Getenv("GEMINI_DAILY_REQUEST_LIMIT"))
+	tokenLimit, _ := strconv.Atoi(os.Getenv("GEMINI_DAILY_TOKEN_LIMIT"))
+
+	status := map[string]interface{}{
+		"today_requests":      requests,
+		"today_tokens":        tokens,
+		"daily_request_limit": requestLimit,
+		"daily_token_limit":   tokenLimit,
+	}
+	if requestLimit > 0 {
+		status["remaining_requests"] = max(requestLimit-requests, 0)
+	}
+	if tokenLimit > 0 {
+		status["remaining_tokens"] = max(tokenLimit-tokens, 0)
+	}
+	return status
+}
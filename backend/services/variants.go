@@ -0,0 +1,88 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"xgastroteca/database"
+	"xgastroteca/models"
+)
+
+// VariantSubstitution replaces one ingredient of the original recipe.
+type VariantSubstitution struct {
+	IngredientID uint   `json:"ingredient_id" binding:"required"`
+	Substitute   string `json:"substitute" binding:"required"`
+	Quantity     string `json:"quantity"` // Empty keeps the original quantity
+}
+
+// CreateVariant saves a copy of a recipe (with ingredients, steps and tags
+// loaded) where some ingredients are replaced. The variant shares the video
+// and images of the original.
+func CreateVariant(original *models.Recipe, subs []VariantSubstitution, title string) (*models.Recipe, error) {
+	replacements := make(map[uint]VariantSubstitution)
+	for _, s := range subs {
+		replacements[s.IngredientID] = s
+	}
+
+	if title == "" {
+		var names []string
+		for _, s := range subs {
+			names = append(names, s.Substitute)
+		}
+		title = fmt.Sprintf("%s (con %s)", original.Title, strings.Join(names, ", "))
+	}
+
+	originalID := original.ID
+	variant := &models.Recipe{
+		LocalVideoPath:    original.LocalVideoPath,
+		OriginalVideoPath: original.OriginalVideoPath,
+		StreamPath:        original.StreamPath,
+		ThumbnailPath:     original.ThumbnailPath,
+		Thumbnails:        original.Thumbnails,
+		Title:             title,
+		Description:       original.Description,
+		CookingTime:       original.CookingTime,
+		Servings:          original.Servings,
+		Language:          original.Language,
+		Transcript:        original.Transcript,
+		SourceMeta:        original.SourceMeta,
+		VariantOfID:       &originalID,
+		Source:            "variant",
+		ExternalID:        fmt.Sprintf("%d-%d", original.ID, time.Now().UnixNano()),
+	}
+
+	for _, ing := range original.Ingredients {
+		item, quantity := ing.Item, ing.Quantity
+		if r, ok := replacements[ing.ID]; ok {
+			item = r.Substitute
+			if r.Quantity != "" {
+				quantity = r.Quantity
+			}
+			delete(replacements, ing.ID)
+		}
+		variant.Ingredients = append(variant.Ingredients, models.Ingredient{Item: item, Quantity: quantity})
+	}
+	for id := range replacements {
+		return nil, fmt.Errorf("ingredient %d does not belong to recipe %d", id, original.ID)
+	}
+
+	for _, s := range original.Steps {
+		variant.Steps = append(variant.Steps, models.Step{
+			Text:         s.Text,
+			StartSeconds: s.StartSeconds,
+			EndSeconds:   s.EndSeconds,
+			ImagePath:    s.ImagePath,
+		})
+	}
+	for _, t := range original.Tags {
+		variant.Tags = append(variant.Tags, models.Tag{Name: t.Name})
+	}
+
+	ComputeNutrition(variant)
+	ClassifyRecipe(variant)
+
+	if err := database.DB.Create(variant).Error; err != nil {
+		return nil, fmt.Errorf("failed to save variant: %v", err)
+	}
+	return variant, nil
+}
@@ -0,0 +1,832 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"xgastroteca/database"
+	"xgastroteca/models"
+	"xgastroteca/storage"
+	"xgastroteca/utils"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	maxWebPageBytes   = 5 << 20
+	maxHeroImageBytes = 15 << 20
+	maxPageTextRunes  = 15000
+	webUserAgent      = "Mozilla/5.0 (compatible; Xgastroteca/1.0; +https://github.com/xtoxico/Xgastroteca)"
+)
+
+var webClient = &http.Client{
+	Timeout:   30 * time.Second,
+	Transport: publicTransport(),
+}
+
+// Shared address space (RFC 6598), not covered by netip.Addr.IsPrivate
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// publicTransport only connects to public addresses, so user submitted URLs
+// can't reach the server itself, the local network or the cloud metadata
+// service (169.254.169.254). The check runs on the resolved address of every
+// connection, redirects included.
+func publicTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip, err := netip.ParseAddr(host)
+			if err != nil {
+				return err
+			}
+			if !isPublicAddr(ip.Unmap()) {
+				return fmt.Errorf("address %s is not public", ip)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil // The proxy would make the connections on our behalf
+	transport.DialContext = dialer.DialContext
+	return transport
+}
+
+func isPublicAddr(ip netip.Addr) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// Extensions for the hero images we keep
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+	"image/gif":  ".gif",
+}
+
+// webRecipe is the recipe found in the structured data (JSON-LD or microdata) of a page.
+type webRecipe struct {
+	Title       string
+	Description string
+	Image       string
+	Author      string
+	CookingTime string
+	Servings    int
+	Language    string
+	Ingredients []string
+	Steps       []string
+	Tags        []string
+}
+
+// ProcessWebPage imports a recipe from a regular web page. schema.org/Recipe
+// data (JSON-LD or microdata) is used when present; otherwise the readable
+// text of the page is sent to the AI. The hero image becomes the thumbnail.
+func ProcessWebPage(pageURL, externalID, canonicalURL string) (*models.Recipe, error) {
+	log.Printf("Processing web page: %s", pageURL)
+
+	body, finalURL, err := fetchWebPage(pageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse page: %v", err)
+	}
+
+	var recipe *models.Recipe
+	image := ""
+
+	wr := findJSONLDRecipe(doc)
+	if wr == nil || len(wr.Ingredients) == 0 {
+		wr = findMicrodataRecipe(doc)
+	}
+
+	if wr != nil && len(wr.Ingredients) > 0 {
+		log.Printf("Found schema.org recipe data: %s", wr.Title)
+		recipe = wr.toRecipe()
+		image = wr.Image
+	} else {
+		log.Printf("No structured recipe data, starting AI analysis of the page text...")
+		recipe, err = analyzePageText(pageTitle(doc), readableText(doc))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	recipe.Source = models.SourceWeb
+	recipe.ExternalID = externalID
+	recipe.CanonicalURL = canonicalURL
+	recipe.SourceMeta.OriginalURL = finalURL
+	if wr != nil {
+		recipe.SourceMeta.Uploader = wr.Author
+	}
+
+	// Hero image as thumbnail
+	if image == "" {
+		image = metaImage(doc)
+	}
+	if image != "" {
+		if thumb, err := downloadHeroImage(resolveURL(finalURL, image)); err != nil {
+			log.Printf("Failed to download hero image: %v", err)
+		} else {
+			recipe.ThumbnailPath = thumb
+			if err := GenerateThumbnails(recipe); err != nil {
+				log.Printf("Failed to generate thumbnails: %v", err)
+			}
+		}
+	}
+
+	// Estimate nutrition from the offline nutrient table
+	ComputeNutrition(recipe)
+
+	// Allergens and vegetarian/vegan flags
+	ClassifyRecipe(recipe)
+
+	// Original language (from the page data, detect it otherwise)
+	recipe.Language = RecipeLanguage(recipe)
+
+	// The page is still worth saving without its image
+	if err := PublishRecipeMedia([]*models.Recipe{recipe}); err != nil {
+		log.Printf("Failed to store hero image: %v", err)
+		for _, key := range append(thumbnailVariantKeys(recipe), recipe.ThumbnailPath) {
+			os.Remove(storage.WorkPath(key))
+		}
+		recipe.ThumbnailPath = ""
+		recipe.Thumbnails = models.ThumbnailSet{}
+	}
+
+	if result := database.DB.Create(recipe); result.Error != nil {
+		log.Printf("Error saving to database: %v", result.Error)
+		return nil, fmt.Errorf("failed to save recipe: %v", result.Error)
+	}
+
+	log.Printf("Recipe saved with ID: %d", recipe.ID)
+	return recipe, nil
+}
+
+// fetchWebPage downloads an HTML page. Returns the body and the URL after redirects.
+func fetchWebPage(pageURL string) ([]byte, string, error) {
+	req, err := http.NewRequest(http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid URL: %v", err)
+	}
+	req.Header.Set("User-Agent", webUserAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := webClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch page: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("failed to fetch page: status %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" && !strings.Contains(ct, "html") {
+		return nil, "", fmt.Errorf("URL is not a web page (%s)", ct)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxWebPageBytes+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read page: %v", err)
+	}
+	if len(body) > maxWebPageBytes {
+		return nil, "", fmt.Errorf("page is larger than %d MB", maxWebPageBytes>>20)
+	}
+	return body, resp.Request.URL.String(), nil
+}
+
+// analyzePageText asks the AI to extract the recipe from the text of a page.
+// Responses are cached by the hash of the text.
+func analyzePageText(title, text string) (*models.Recipe, error) {
+	if len(strings.Fields(text)) < 30 {
+		return nil, fmt.Errorf("page has no readable text")
+	}
+
+	sum := sha256.Sum256([]byte(text))
+	textHash := hex.EncodeToString(sum[:])
+
+	var jsonText string
+	var usage models.TokenUsage
+	cached := FindCachedAnalysis(textHash, "")
+	if cached != nil {
+		log.Printf("Reusing cached AI response #%d for this page", cached.ID)
+		jsonText = cached.Response
+		usage = models.TokenUsage{Model: cached.AIModel}
+	} else {
+		prompt := "Eres un chef experto. Extrae la receta del siguiente texto de una página web en formato JSON. Incluye: title, description, ingredients (lista de objetos con campos 'item' y 'quantity'), steps (lista de textos), tags, cooking_time, servings (número entero de raciones, 0 si no se indica) y language (código ISO 639-1 del idioma de la página, ej: es, en, it, pt). Escribe la receta en el idioma original de la página. Ignora comentarios, menús y publicidad. IMPORTANTE: Si la página NO contiene una receta de cocina, devuelve un JSON ÚNICAMENTE con el campo: {\"error\": \"not_a_recipe\"}. Responde SOLO con el JSON limpio, sin bloques de código markdown."
+		prompt += "\n\nTítulo de la página: " + title + "\n\nTexto de la página:\n" + text
+
+		var err error
+		jsonText, usage, err = generateText("analyze_webpage", prompt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	recipe, err := recipeFromAIResponse(jsonText)
+	if cached == nil && isFinalAIAnswer(err) {
+		StoreCachedAnalysis(textHash, "", usage.Model, jsonText)
+	}
+	if err != nil {
+		return nil, err
+	}
+	recipe.AIUsage = usage
+	return recipe, nil
+}
+
+// downloadHeroImage saves the main image of a page in the videos directory
+// and returns its public path.
+func downloadHeroImage(imageURL string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, imageURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", webUserAgent)
+
+	resp, err := webClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxHeroImageBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxHeroImageBytes {
+		return "", fmt.Errorf("image is larger than %d MB", maxHeroImageBytes>>20)
+	}
+
+	// The type comes from the content, servers often send a wrong header
+	contentType := http.DetectContentType(data)
+	ext, ok := imageExtensions[contentType]
+	if !ok {
+		return "", fmt.Errorf("unsupported image type %q", contentType)
+	}
+
+	filename := fmt.Sprintf("web_%d%s", time.Now().UnixNano(), ext)
+	if err := os.WriteFile(filepath.Join(videosPath, filename), data, 0644); err != nil {
+		return "", err
+	}
+	return "videos/" + filename, nil
+}
+
+// toRecipe converts the structured data of a page into a recipe.
+func (wr *webRecipe) toRecipe() *models.Recipe {
+	recipe := &models.Recipe{
+		Title:       wr.Title,
+		Description: wr.Description,
+		CookingTime: wr.CookingTime,
+		Servings:    wr.Servings,
+		Language:    wr.Language,
+	}
+	for _, line := range wr.Ingredients {
+		quantity, item := utils.SplitIngredientLine(line)
+		recipe.Ingredients = append(recipe.Ingredients, models.Ingredient{Item: item, Quantity: quantity})
+	}
+	for _, text := range wr.Steps {
+		recipe.Steps = append(recipe.Steps, models.Step{Text: text})
+	}
+	for _, name := range wr.Tags {
+		recipe.Tags = append(recipe.Tags, models.Tag{Name: name})
+	}
+	return recipe
+}
+
+// --- JSON-LD ---
+
+// findJSONLDRecipe looks for a schema.org Recipe in the JSON-LD scripts of a page.
+func findJSONLDRecipe(doc *html.Node) *webRecipe {
+	for _, script := range findNodes(doc, func(n *html.Node) bool {
+		return n.DataAtom == atom.Script && strings.Contains(attr(n, "type"), "ld+json")
+	}) {
+		var data interface{}
+		if err := json.Unmarshal([]byte(textContent(script)), &data); err != nil {
+			continue
+		}
+		if obj := findRecipeObject(data); obj != nil {
+			return recipeFromJSONLD(obj)
+		}
+	}
+	return nil
+}
+
+// findRecipeObject finds the Recipe object in a JSON-LD document, which may be
+// a list, an object with @graph, or a page with the recipe as mainEntity.
+func findRecipeObject(v interface{}) map[string]interface{} {
+	switch t := v.(type) {
+	case []interface{}:
+		for _, item := range t {
+			if obj := findRecipeObject(item); obj != nil {
+				return obj
+			}
+		}
+	case map[string]interface{}:
+		if isSchemaType(t["@type"], "Recipe") {
+			return t
+		}
+		for _, key := range []string{"@graph", "mainEntity"} {
+			if obj := findRecipeObject(t[key]); obj != nil {
+				return obj
+			}
+		}
+	}
+	return nil
+}
+
+func isSchemaType(v interface{}, name string) bool {
+	switch t := v.(type) {
+	case string:
+		return t == name || strings.HasSuffix(t, "/"+name) || strings.HasSuffix(t, ":"+name)
+	case []interface{}:
+		for _, item := range t {
+			if isSchemaType(item, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func recipeFromJSONLD(obj map[string]interface{}) *webRecipe {
+	wr := &webRecipe{
+		Title:       jsonLDText(obj["name"]),
+		Description: jsonLDText(obj["description"]),
+		Image:       jsonLDImage(obj["image"]),
+		Author:      jsonLDText(obj["author"]),
+		Servings:    parseYield(jsonLDText(obj["recipeYield"])),
+		Language:    languageCode(jsonLDText(obj["inLanguage"])),
+		Steps:       jsonLDInstructions(obj["recipeInstructions"]),
+	}
+
+	ingredients := obj["recipeIngredient"]
+	if ingredients == nil {
+		ingredients = obj["ingredients"] // Older schema.org name
+	}
+	wr.Ingredients = jsonLDList(ingredients)
+
+	minutes := parseISODuration(jsonLDText(obj["totalTime"]))
+	if minutes == 0 {
+		minutes = parseISODuration(jsonLDText(obj["prepTime"])) + parseISODuration(jsonLDText(obj["cookTime"]))
+	}
+	wr.CookingTime = formatMinutes(minutes)
+
+	for _, key := range []string{"recipeCategory", "recipeCuisine", "keywords"} {
+		for _, value := range jsonLDList(obj[key]) {
+			for _, tag := range strings.Split(value, ",") {
+				wr.Tags = appendTag(wr.Tags, tag)
+			}
+		}
+	}
+	return wr
+}
+
+// jsonLDText returns the text of a JSON-LD value: plain values, the name or
+// text of an object, or the first element of a list.
+func jsonLDText(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return cleanText(t)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case map[string]interface{}:
+		for _, key := range []string{"text", "name", "@value"} {
+			if s := jsonLDText(t[key]); s != "" {
+				return s
+			}
+		}
+	case []interface{}:
+		for _, item := range t {
+			if s := jsonLDText(item); s != "" {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// jsonLDList returns the texts of a JSON-LD list (or a single value).
+func jsonLDList(v interface{}) []string {
+	var result []string
+	switch t := v.(type) {
+	case []interface{}:
+		for _, item := range t {
+			if s := jsonLDText(item); s != "" {
+				result = append(result, s)
+			}
+		}
+	default:
+		if s := jsonLDText(t); s != "" {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// jsonLDInstructions flattens recipeInstructions: plain text, lists of
+// HowToStep and HowToSection with their own itemListElement.
+func jsonLDInstructions(v interface{}) []string {
+	var steps []string
+	switch t := v.(type) {
+	case string:
+		for _, line := range strings.Split(htmlBreakRegex.ReplaceAllString(t, "\n"), "\n") {
+			if line = cleanText(line); line != "" {
+				steps = append(steps, line)
+			}
+		}
+	case []interface{}:
+		for _, item := range t {
+			steps = append(steps, jsonLDInstructions(item)...)
+		}
+	case map[string]interface{}:
+		if elements, ok := t["itemListElement"]; ok {
+			return jsonLDInstructions(elements)
+		}
+		if s := jsonLDText(t); s != "" {
+			steps = append(steps, s)
+		}
+	}
+	return steps
+}
+
+func jsonLDImage(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case []interface{}:
+		if len(t) > 0 {
+			return jsonLDImage(t[0])
+		}
+	case map[string]interface{}:
+		if s, ok := t["url"].(string); ok {
+			return s
+		}
+		if s, ok := t["contentUrl"].(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+// --- Microdata ---
+
+// findMicrodataRecipe reads a schema.org Recipe marked up with itemscope/itemprop.
+func findMicrodataRecipe(doc *html.Node) *webRecipe {
+	scopes := findNodes(doc, func(n *html.Node) bool {
+		return hasAttr(n, "itemscope") && strings.HasSuffix(strings.TrimSuffix(attr(n, "itemtype"), "/"), "schema.org/Recipe")
+	})
+	if len(scopes) == 0 {
+		return nil
+	}
+
+	wr := &webRecipe{}
+	minutes, prepMinutes := 0, 0
+	walkItemProps(scopes[0], func(prop string, n *html.Node) {
+		switch prop {
+		case "name":
+			if wr.Title == "" {
+				wr.Title = microdataValue(n)
+			}
+		case "description":
+			if wr.Description == "" {
+				wr.Description = microdataValue(n)
+			}
+		case "image":
+			if wr.Image == "" {
+				wr.Image = microdataValue(n)
+			}
+		case "author":
+			if wr.Author == "" {
+				wr.Author = microdataValue(n)
+			}
+		case "recipeIngredient", "ingredients":
+			if s := microdataValue(n); s != "" {
+				wr.Ingredients = append(wr.Ingredients, s)
+			}
+		case "recipeInstructions":
+			wr.Steps = append(wr.Steps, blockTexts(n)...)
+		case "recipeYield":
+			wr.Servings = parseYield(microdataValue(n))
+		case "totalTime":
+			minutes = parseISODuration(microdataValue(n))
+		case "prepTime", "cookTime":
+			prepMinutes += parseISODuration(microdataValue(n))
+		case "inLanguage":
+			wr.Language = languageCode(microdataValue(n))
+		case "recipeCategory", "recipeCuisine", "keywords":
+			for _, tag := range strings.Split(microdataValue(n), ",") {
+				wr.Tags = appendTag(wr.Tags, tag)
+			}
+		}
+	})
+
+	if minutes == 0 {
+		minutes = prepMinutes
+	}
+	wr.CookingTime = formatMinutes(minutes)
+	return wr
+}
+
+// walkItemProps calls fn for every itemprop of an item. Nested items (author,
+// HowToStep...) are passed as a whole, their own properties are not visited.
+func walkItemProps(scope *html.Node, fn func(prop string, n *html.Node)) {
+	for c := scope.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		if props := attr(c, "itemprop"); props != "" {
+			for _, prop := range strings.Fields(props) {
+				fn(prop, c)
+			}
+		}
+		if !hasAttr(c, "itemscope") {
+			walkItemProps(c, fn)
+		}
+	}
+}
+
+// microdataValue returns the value of an itemprop element following the microdata rules.
+func microdataValue(n *html.Node) string {
+	if hasAttr(n, "itemscope") {
+		// Nested item: use its name or text
+		var name string
+		walkItemProps(n, func(prop string, c *html.Node) {
+			if (prop == "name" || prop == "text") && name == "" {
+				name = microdataValue(c)
+			}
+		})
+		if name != "" {
+			return name
+		}
+		return cleanText(textContent(n))
+	}
+
+	switch n.DataAtom {
+	case atom.Meta:
+		return cleanText(attr(n, "content"))
+	case atom.Img, atom.Audio, atom.Video, atom.Source:
+		return attr(n, "src")
+	case atom.A, atom.Link:
+		return attr(n, "href")
+	case atom.Time:
+		if dt := attr(n, "datetime"); dt != "" {
+			return dt
+		}
+	case atom.Data, atom.Meter:
+		return attr(n, "value")
+	}
+	if content := attr(n, "content"); content != "" {
+		return cleanText(content)
+	}
+	return cleanText(textContent(n))
+}
+
+// blockTexts splits an instructions element into steps (list items or paragraphs).
+func blockTexts(n *html.Node) []string {
+	if hasAttr(n, "itemscope") {
+		if s := microdataValue(n); s != "" {
+			return []string{s}
+		}
+		return nil
+	}
+
+	var texts []string
+	for _, block := range findNodes(n, func(c *html.Node) bool { return c.DataAtom == atom.Li || c.DataAtom == atom.P }) {
+		if s := cleanText(textContent(block)); s != "" {
+			texts = append(texts, s)
+		}
+	}
+	if len(texts) == 0 {
+		if s := microdataValue(n); s != "" {
+			texts = append(texts, s)
+		}
+	}
+	return texts
+}
+
+// --- Page text and images ---
+
+// Elements that are not part of the readable content of a page
+var skippedElements = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Noscript: true, atom.Nav: true,
+	atom.Header: true, atom.Footer: true, atom.Aside: true, atom.Form: true,
+	atom.Svg: true, atom.Iframe: true, atom.Template: true, atom.Button: true,
+}
+
+// readableText returns the visible text of a page without navigation,
+// scripts and other boilerplate, one block per line.
+func readableText(doc *html.Node) string {
+	var sb strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && skippedElements[n.DataAtom] {
+			return
+		}
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+			sb.WriteString(" ")
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+		if n.Type == html.ElementNode && isBlockElement(n.DataAtom) {
+			sb.WriteString("\n")
+		}
+	}
+	walk(doc)
+
+	var lines []string
+	for _, line := range strings.Split(sb.String(), "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	text := []rune(strings.Join(lines, "\n"))
+	if len(text) > maxPageTextRunes {
+		text = text[:maxPageTextRunes]
+	}
+	return string(text)
+}
+
+func isBlockElement(a atom.Atom) bool {
+	switch a {
+	case atom.P, atom.Div, atom.Li, atom.Br, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6,
+		atom.Tr, atom.Section, atom.Article, atom.Ul, atom.Ol, atom.Table, atom.Blockquote:
+		return true
+	}
+	return false
+}
+
+func pageTitle(doc *html.Node) string {
+	if titles := findNodes(doc, func(n *html.Node) bool { return n.DataAtom == atom.Title }); len(titles) > 0 {
+		return cleanText(textContent(titles[0]))
+	}
+	return ""
+}
+
+// metaImage returns the Open Graph (or Twitter card) image of a page.
+func metaImage(doc *html.Node) string {
+	for _, name := range []string{"og:image", "og:image:url", "twitter:image"} {
+		for _, meta := range findNodes(doc, func(n *html.Node) bool { return n.DataAtom == atom.Meta }) {
+			if (attr(meta, "property") == name || attr(meta, "name") == name) && attr(meta, "content") != "" {
+				return attr(meta, "content")
+			}
+		}
+	}
+	return ""
+}
+
+func resolveURL(base, ref string) string {
+	b, err := neturl.Parse(base)
+	if err != nil {
+		return ref
+	}
+	r, err := neturl.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return ref
+	}
+	return b.ResolveReference(r).String()
+}
+
+// --- Helpers ---
+
+var (
+	htmlTagRegex   = regexp.MustCompile(`<[^>]*>`)
+	htmlBreakRegex = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</li>`)
+	isoDuration    = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:[\d.]+S)?)?$`)
+	firstNumber    = regexp.MustCompile(`\d+`)
+
+	// Spaces left before punctuation by removed inline tags ("<b>todo</b>.")
+	punctuationSpace = strings.NewReplacer(" .", ".", " ,", ",", " :", ":", " ;", ";")
+)
+
+// cleanText removes HTML tags and entities and collapses whitespace.
+func cleanText(s string) string {
+	s = html.UnescapeString(htmlTagRegex.ReplaceAllString(s, " "))
+	return punctuationSpace.Replace(strings.Join(strings.Fields(s), " "))
+}
+
+// parseISODuration converts an ISO 8601 duration (PT1H30M) to minutes.
+func parseISODuration(s string) int {
+	m := isoDuration.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(s)))
+	if m == nil {
+		return 0
+	}
+	days, _ := strconv.Atoi(m[1])
+	hours, _ := strconv.Atoi(m[2])
+	minutes, _ := strconv.Atoi(m[3])
+	return days*24*60 + hours*60 + minutes
+}
+
+func formatMinutes(minutes int) string {
+	switch {
+	case minutes <= 0:
+		return ""
+	case minutes < 60:
+		return fmt.Sprintf("%d min", minutes)
+	case minutes%60 == 0:
+		return fmt.Sprintf("%d h", minutes/60)
+	default:
+		return fmt.Sprintf("%d h %d min", minutes/60, minutes%60)
+	}
+}
+
+// parseYield takes the number of servings from texts like "4", "4 raciones" or "Serves 4".
+func parseYield(s string) int {
+	n, _ := strconv.Atoi(firstNumber.FindString(s))
+	return n
+}
+
+// languageCode reduces a language tag such as "es-ES" to its ISO 639-1 code.
+func languageCode(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if len(s) > 2 {
+		s = s[:2]
+	}
+	return s
+}
+
+func appendTag(tags []string, tag string) []string {
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return tags
+	}
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return tags
+		}
+	}
+	return append(tags, tag)
+}
+
+func findNodes(root *html.Node, match func(*html.Node) bool) []*html.Node {
+	var result []*html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && match(n) {
+			result = append(result, n)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(root)
+	return result
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return strings.TrimSpace(a.Val)
+		}
+	}
+	return ""
+}
+
+func hasAttr(n *html.Node, key string) bool {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var sb strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sb.WriteString(textContent(c))
+		if c.Type == html.ElementNode && isBlockElement(c.DataAtom) {
+			sb.WriteString(" ")
+		}
+	}
+	return sb.String()
+}
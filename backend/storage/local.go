@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LocalStore keeps the media on disk, under Root (./data by default, so
+// "videos/x.mp4" is ./data/videos/x.mp4).
+type LocalStore struct {
+	Root string
+}
+
+// NewLocalStore opens a store rooted at a directory, creating it if needed.
+func NewLocalStore(root string) (*LocalStore, error) {
+	if err := os.MkdirAll(filepath.Join(root, "videos"), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create media directory: %v", err)
+	}
+	return &LocalStore{Root: root}, nil
+}
+
+func (s *LocalStore) path(key string) (string, error) {
+	cleaned, err := CleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(cleaned)), nil
+}
+
+// Put writes the file through a temporary name, so readers never see it half written.
+func (s *LocalStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	tmp := p + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", key, err)
+	}
+	_, err = io.Copy(f, r)
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %v", key, err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to store %s: %v", key, err)
+	}
+	return nil
+}
+
+func (s *LocalStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// Delete removes a file and the directories left empty by it (HLS segments).
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ErrNotFound
+		}
+		return err
+	}
+	// Top level directories (videos/) stay
+	root := filepath.Clean(s.Root)
+	for dir := filepath.Dir(p); strings.HasPrefix(dir, root) && filepath.Dir(dir) != root && dir != root; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *LocalStore) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && info.IsDir()) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	cleaned, _ := CleanKey(key)
+	return &ObjectInfo{Key: cleaned, Size: info.Size(), ModTime: info.ModTime(), ContentType: ContentType(key)}, nil
+}
+
+// SignedURL returns the path served by the API; local files need no signature.
+func (s *LocalStore) SignedURL(ctx context.Context, key string, expires time.Duration) (string, error) {
+	cleaned, err := CleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return "/" + cleaned, nil
+}
+
+func (s *LocalStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	root := filepath.Clean(s.Root)
+	var objects []ObjectInfo
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return nil
+		}
+		key := filepath.ToSlash(rel)
+		// Only media, not the database or the upload sessions
+		if !isMediaKey(key) || !strings.HasPrefix(key, prefix) || strings.HasSuffix(key, ".tmp") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		objects = append(objects, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime(), ContentType: ContentType(key)})
+		return nil
+	})
+	return objects, err
+}
+
+// Top level directories holding media in the local store
+var mediaDirs = []string{"videos/", "quarantine/"}
+
+func isMediaKey(key string) bool {
+	for _, dir := range mediaDirs {
+		if strings.HasPrefix(key, dir) {
+			return true
+		}
+	}
+	return false
+}
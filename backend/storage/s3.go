@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Store keeps the media in an S3 compatible bucket (AWS, MinIO, R2...).
+type S3Store struct {
+	Client *minio.Client
+	Bucket string
+	Prefix string // Optional key prefix inside the bucket, e.g. "gastroteca/"
+}
+
+// NewS3StoreFromEnv connects to the bucket configured in S3_ENDPOINT,
+// S3_BUCKET, S3_ACCESS_KEY, S3_SECRET_KEY, S3_REGION, S3_USE_SSL,
+// S3_PATH_STYLE and S3_PREFIX. The bucket is created if missing.
+func NewS3StoreFromEnv() (*S3Store, error) {
+	endpoint := os.Getenv("S3_ENDPOINT")
+	bucket := os.Getenv("S3_BUCKET")
+	if endpoint == "" || bucket == "" {
+		return nil, errors.New("S3_ENDPOINT and S3_BUCKET are required for the s3 storage backend")
+	}
+
+	// Accept full URLs too (http://localhost:9000)
+	useSSL := os.Getenv("S3_USE_SSL") != "false"
+	if strings.HasPrefix(endpoint, "http://") {
+		useSSL = false
+	}
+	endpoint = strings.TrimPrefix(strings.TrimPrefix(endpoint, "https://"), "http://")
+	endpoint = strings.TrimSuffix(endpoint, "/")
+
+	lookup := minio.BucketLookupAuto
+	if os.Getenv("S3_PATH_STYLE") == "true" {
+		lookup = minio.BucketLookupPath // MinIO and most self hosted servers
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(os.Getenv("S3_ACCESS_KEY"), os.Getenv("S3_SECRET_KEY"), ""),
+		Secure:       useSSL,
+		Region:       os.Getenv("S3_REGION"),
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 configuration: %v", err)
+	}
+
+	store := &S3Store{Client: client, Bucket: bucket, Prefix: os.Getenv("S3_PREFIX")}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	exists, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach S3 bucket %s: %v", bucket, err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{Region: os.Getenv("S3_REGION")}); err != nil {
+			return nil, fmt.Errorf("failed to create S3 bucket %s: %v", bucket, err)
+		}
+	}
+	return store, nil
+}
+
+func (s *S3Store) object(key string) (string, error) {
+	cleaned, err := CleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return s.Prefix + cleaned, nil
+}
+
+// s3Error turns the "no such key" answers into ErrNotFound.
+func s3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch minio.ToErrorResponse(err).Code {
+	case minio.NoSuchKey, "NotFound":
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	name, err := s.object(key)
+	if err != nil {
+		return err
+	}
+	_, err = s.Client.PutObject(ctx, s.Bucket, name, r, size, minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %v", key, err)
+	}
+	return nil
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	name, err := s.object(key)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := s.Client.GetObject(ctx, s.Bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	// GetObject is lazy, Stat makes the request so missing keys fail here
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, s3Error(err)
+	}
+	return obj, nil
+}
+
+// Delete removes a key. S3 doesn't report missing keys, so neither does this.
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	name, err := s.object(key)
+	if err != nil {
+		return err
+	}
+	return s3Error(s.Client.RemoveObject(ctx, s.Bucket, name, minio.RemoveObjectOptions{}))
+}
+
+func (s *S3Store) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	name, err := s.object(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.Client.StatObject(ctx, s.Bucket, name, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return &ObjectInfo{
+		Key:         strings.TrimPrefix(info.Key, s.Prefix),
+		Size:        info.Size,
+		ModTime:     info.LastModified,
+		ContentType: info.ContentType,
+	}, nil
+}
+
+func (s *S3Store) SignedURL(ctx context.Context, key string, expires time.Duration) (string, error) {
+	name, err := s.object(key)
+	if err != nil {
+		return "", err
+	}
+	u, err := s.Client.PresignedGetObject(ctx, s.Bucket, name, expires, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign URL for %s: %v", key, err)
+	}
+	return u.String(), nil
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	for info := range s.Client.ListObjects(ctx, s.Bucket, minio.ListObjectsOptions{Prefix: s.Prefix + prefix, Recursive: true}) {
+		if info.Err != nil {
+			return nil, fmt.Errorf("failed to list media: %v", info.Err)
+		}
+		objects = append(objects, ObjectInfo{
+			Key:         strings.TrimPrefix(info.Key, s.Prefix),
+			Size:        info.Size,
+			ModTime:     info.LastModified,
+			ContentType: ContentType(info.Key),
+		})
+	}
+	return objects, nil
+}
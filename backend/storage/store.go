@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WorkDir is the local directory where the pipeline writes its files
+// (downloads, renditions, keyframes) before they are published to the store.
+const WorkDir = "./data"
+
+// SignedURLExpiry is the lifetime of the URLs handed to clients by remote stores.
+const SignedURLExpiry = time.Hour
+
+// ErrNotFound is returned when a key doesn't exist in the store.
+var ErrNotFound = errors.New("media not found")
+
+// MediaStore keeps the media of the recipes (videos, thumbnails, step stills,
+// HLS segments). Keys are the paths stored in the recipes, e.g. "videos/video_123.mp4".
+type MediaStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	// SignedURL returns a temporary URL to download the key. For the local
+	// store it is the path served by the API.
+	SignedURL(ctx context.Context, key string, expires time.Duration) (string, error)
+	// List returns every object whose key starts with prefix.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// ObjectInfo describes a stored file.
+type ObjectInfo struct {
+	Key         string    `json:"key"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mod_time"`
+	ContentType string    `json:"content_type"`
+}
+
+// Media is the store configured with STORAGE_BACKEND.
+var Media MediaStore
+
+// InitStorage opens the configured media store.
+func InitStorage() {
+	var err error
+	Media, err = New(os.Getenv("STORAGE_BACKEND"))
+	if err != nil {
+		log.Fatal("Failed to open media store:", err)
+	}
+}
+
+// New builds a store by name: "local" (default) or "s3".
+func New(backend string) (MediaStore, error) {
+	switch backend {
+	case "", "local":
+		root := os.Getenv("STORAGE_LOCAL_ROOT")
+		if root == "" {
+			root = WorkDir
+		}
+		return NewLocalStore(root)
+	case "s3":
+		return NewS3StoreFromEnv()
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", backend)
+}
+
+// CleanKey normalizes a key and rejects the ones escaping the store root.
+func CleanKey(key string) (string, error) {
+	cleaned := strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(key, "\\", "/")), "/")
+	if cleaned == "" || cleaned == "." {
+		return "", fmt.Errorf("invalid media key %q", key)
+	}
+	return cleaned, nil
+}
+
+// Some media types used by the pipeline that mime doesn't always know
+var contentTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".mov":  "video/quicktime",
+	".webm": "video/webm",
+	".mkv":  "video/x-matroska",
+	".3gp":  "video/3gpp",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".webp": "image/webp",
+}
+
+// ContentType guesses the media type of a key from its extension.
+func ContentType(key string) string {
+	ext := strings.ToLower(path.Ext(key))
+	if ct, ok := contentTypes[ext]; ok {
+		return ct
+	}
+	if ct := mime.TypeByExtension(ext); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
+// WorkPath returns where the pipeline keeps the local copy of a key.
+func WorkPath(key string) string {
+	return filepath.Join(WorkDir, filepath.FromSlash(key))
+}
+
+// LocalPath returns the file of a key when the store keeps it on this disk.
+func LocalPath(store MediaStore, key string) (string, bool) {
+	local, ok := store.(*LocalStore)
+	if !ok {
+		return "", false
+	}
+	p, err := local.path(key)
+	if err != nil {
+		return "", false
+	}
+	return p, true
+}
+
+// PutFile uploads a local file under key. Nothing is copied when the store
+// already keeps the key at that path.
+func PutFile(ctx context.Context, store MediaStore, key, localPath string) error {
+	if p, ok := LocalPath(store, key); ok && SameFile(p, localPath) {
+		return nil
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", localPath, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %v", localPath, err)
+	}
+	return store.Put(ctx, key, f, info.Size(), ContentType(key))
+}
+
+// DeletePrefix removes every object under prefix (e.g. an HLS directory).
+func DeletePrefix(ctx context.Context, store MediaStore, prefix string) error {
+	objects, err := store.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if err := store.Delete(ctx, obj.Key); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// SameFile reports whether two paths are the same file or directory, however
+// they are written ("data/videos" and "/app/data/videos").
+func SameFile(a, b string) bool {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(infoA, infoB)
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// Query parameters that only track how or where a link was shared
+var trackingParams = map[string]bool{
+	"igsh": true, "igshid": true, "si": true, "fbclid": true, "gclid": true, "dclid": true,
+	"msclkid": true, "mibextid": true, "feature": true, "ref": true, "ref_src": true,
+	"share_id": true, "share_app_id": true, "sender_device": true, "is_from_webapp": true,
+	"_r": true, "_t": true, "mc_cid": true, "mc_eid": true, "rdt": true,
+}
+
+// Link shorteners not tied to a platform. Platform short links (vm.tiktok.com,
+// fb.watch, pin.it...) are detected because no video ID can be read from them.
+var shortenerHosts = []string{"bit.ly", "t.co", "tinyurl.com", "goo.gl", "ow.ly", "buff.ly", "lnkd.in", "is.gd", "rebrand.ly", "cutt.ly"}
+
+// IsTrackingParam reports whether a query parameter only tracks sharing (utm_*, igsh, fbclid...).
+func IsTrackingParam(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasPrefix(name, "utm_") || trackingParams[name]
+}
+
+// StripTrackingParams removes tracking query parameters and the fragment of a URL.
+func StripTrackingParams(rawURL string) string {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return rawURL
+	}
+	u.Fragment = ""
+	u.RawQuery = cleanQuery(u.Query())
+	return u.String()
+}
+
+// cleanQuery encodes the non-tracking parameters of a query, sorted by name.
+func cleanQuery(query url.Values) string {
+	for name := range query {
+		if IsTrackingParam(name) {
+			query.Del(name)
+		}
+	}
+	return query.Encode() // Encode sorts by key
+}
+
+// CanonicalWebURL normalizes a web page URL: lowercase host without "www.",
+// no trailing slash, fragment or tracking parameters, and sorted query.
+func CanonicalWebURL(rawURL string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", errors.New("not a valid web page URL")
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+	host = strings.TrimSuffix(strings.TrimSuffix(host, ":443"), ":80")
+	path := strings.TrimSuffix(u.EscapedPath(), "/")
+
+	canonical := u.Scheme + "://" + host + path
+	if query := cleanQuery(u.Query()); query != "" {
+		canonical += "?" + query
+	}
+	return canonical, nil
+}
+
+// CanonicalizeURL identifies a video or web page URL and returns its source,
+// external ID and canonical URL, so a recipe is found again however the link
+// was shared.
+func CanonicalizeURL(rawURL string) (source, externalID, canonical string, err error) {
+	source, externalID, err = ExtractVideoInfo(rawURL)
+	if err == nil {
+		return source, externalID, FindSource(source).CanonicalURL(externalID), nil
+	}
+	if !errors.Is(err, ErrPlatformNotSupported) {
+		return "", "", "", err
+	}
+
+	canonical, err = CanonicalWebURL(rawURL)
+	if err != nil {
+		return "", "", "", err
+	}
+	_, externalID, _ = strings.Cut(canonical, "://")
+	return "web", externalID, canonical, nil
+}
+
+// NeedsResolution reports whether a URL is a short link that must be followed
+// before it can be identified: generic shorteners and platform URLs without
+// a video ID (vm.tiktok.com/..., fb.watch/..., pin.it/...).
+func NeedsResolution(rawURL string) bool {
+	host := urlHost(rawURL)
+	for _, h := range shortenerHosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	_, _, err := ExtractVideoInfo(rawURL)
+	return err != nil && !errors.Is(err, ErrPlatformNotSupported)
+}
@@ -2,61 +2,38 @@ package utils
 
 import (
 	"errors"
-	"regexp"
+	"fmt"
+	"net/url"
 	"strings"
 )
 
-// ExtractVideoInfo parses a video URL to identify the platform (source) and the unique video ID (externalID).
-// Supported sources: youtube, instagram, tiktok.
-func ExtractVideoInfo(url string) (source string, externalID string, err error) {
-	// YouTube
-	// Supports: youtube.com/watch?v=ID, youtube.com/shorts/ID, youtu.be/ID
-	if strings.Contains(url, "youtube.com") || strings.Contains(url, "youtu.be") {
-		// Try Shorts
-		reShorts := regexp.MustCompile(`youtube\.com/shorts/([a-zA-Z0-9_-]+)`)
-		match := reShorts.FindStringSubmatch(url)
-		if len(match) > 1 {
-			return "youtube", match[1], nil
-		}
-
-		// Try Watch ?v=
-		reWatch := regexp.MustCompile(`[?&]v=([a-zA-Z0-9_-]+)`)
-		match = reWatch.FindStringSubmatch(url)
-		if len(match) > 1 {
-			return "youtube", match[1], nil
-		}
+// ErrPlatformNotSupported is returned by ExtractVideoInfo for URLs of unknown sites.
+var ErrPlatformNotSupported = errors.New("platform not supported")
 
-		// Try youtu.be/ID
-		reShortened := regexp.MustCompile(`youtu\.be/([a-zA-Z0-9_-]+)`)
-		match = reShortened.FindStringSubmatch(url)
-		if len(match) > 1 {
-			return "youtube", match[1], nil
-		}
-
-		return "", "", errors.New("could not extract youtube ID")
+// ExtractVideoInfo parses a video URL to identify the platform (source) and the unique video ID (externalID).
+// Platforms come from the source registry (see Sources); other sites return ErrPlatformNotSupported.
+func ExtractVideoInfo(rawURL string) (source string, externalID string, err error) {
+	src := SourceForHost(urlHost(rawURL))
+	if src == nil {
+		return "", "", ErrPlatformNotSupported
 	}
 
-	// Instagram
-	// Supports: instagram.com/reel/ID, instagram.com/p/ID
-	if strings.Contains(url, "instagram.com") {
-		reInsta := regexp.MustCompile(`instagram\.com/(?:p|reel)/([a-zA-Z0-9_-]+)`)
-		match := reInsta.FindStringSubmatch(url)
-		if len(match) > 1 {
-			return "instagram", match[1], nil
-		}
-		return "", "", errors.New("could not extract instagram ID")
+	id, ok := src.ExtractID(rawURL)
+	if !ok {
+		return "", "", fmt.Errorf("could not extract %s ID", src.Name)
 	}
+	return src.Name, id, nil
+}
 
-	// TikTok
-	// Supports: tiktok.com/@user/video/ID
-	if strings.Contains(url, "tiktok.com") {
-		reTikTok := regexp.MustCompile(`tiktok\.com/.*/video/(\d+)`)
-		match := reTikTok.FindStringSubmatch(url)
-		if len(match) > 1 {
-			return "tiktok", match[1], nil
-		}
-		return "", "", errors.New("could not extract tiktok ID")
+// urlHost returns the lowercase host of a URL, which may be pasted without scheme.
+func urlHost(rawURL string) string {
+	rawURL = strings.TrimSpace(rawURL)
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
 	}
-
-	return "", "", errors.New("platform not supported")
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
 }
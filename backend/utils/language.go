@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Frequent words that are (mostly) exclusive to each supported language
+var languageStopwords = map[string][]string{
+	"es": {"el", "la", "los", "las", "de", "del", "y", "con", "para", "una", "un", "en", "al", "se", "hasta", "cucharada", "sal", "horno", "minutos", "hornear", "añadir", "mezclar", "pimienta"},
+	"en": {"the", "and", "with", "of", "to", "for", "until", "add", "mix", "cup", "bake", "minutes", "oven", "salt", "pepper", "into", "tablespoon", "a", "in"},
+	"it": {"il", "lo", "gli", "di", "della", "con", "per", "una", "e", "fino", "aggiungere", "cucchiaio", "forno", "sale", "pepe", "minuti", "mescolare", "olio"},
+	"pt": {"o", "os", "as", "do", "da", "dos", "com", "para", "uma", "um", "e", "até", "adicione", "colher", "forno", "sal", "pimenta", "minutos", "misture", "azeite"},
+}
+
+var wordRegex = regexp.MustCompile(`\p{L}+`)
+
+// SupportedLanguages lists the languages DetectLanguage can recognize.
+var SupportedLanguages = []string{"es", "en", "it", "pt"}
+
+// DetectLanguage guesses the language (ISO 639-1) of a recipe text by
+// counting stopwords. Returns "" when the text gives no clue.
+func DetectLanguage(text string) string {
+	sets := make(map[string]map[string]bool)
+	for lang, words := range languageStopwords {
+		sets[lang] = make(map[string]bool)
+		for _, w := range words {
+			sets[lang][w] = true
+		}
+	}
+
+	scores := make(map[string]int)
+	for _, w := range wordRegex.FindAllString(strings.ToLower(text), -1) {
+		for lang, set := range sets {
+			if set[w] {
+				scores[lang]++
+			}
+		}
+	}
+
+	best, bestScore := "", 0
+	for _, lang := range SupportedLanguages {
+		if scores[lang] > bestScore {
+			best, bestScore = lang, scores[lang]
+		}
+	}
+	return best
+}
+
+// ParseAcceptLanguage returns the base language codes of an Accept-Language
+// header ordered by preference ("es-ES,en;q=0.8" -> ["es", "en"]).
+func ParseAcceptLanguage(header string) []string {
+	type langQ struct {
+		lang string
+		q    float64
+	}
+
+	var entries []langQ
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		entries = append(entries, langQ{lang: strings.SplitN(tag, "-", 2)[0], q: q})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].q > entries[j].q })
+
+	seen := make(map[string]bool)
+	var langs []string
+	for _, e := range entries {
+		if e.q > 0 && !seen[e.lang] {
+			seen[e.lang] = true
+			langs = append(langs, e.lang)
+		}
+	}
+	return langs
+}
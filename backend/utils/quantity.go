@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Leading words that stand for a number ("una taza", "medio limón")
+var wordNumbers = map[string]string{
+	"un ": "1 ", "una ": "1 ", "uno ": "1 ", "a ": "1 ", "an ": "1 ", "one ": "1 ",
+	"medio ": "0.5 ", "media ": "0.5 ", "half ": "0.5 ",
+	"dos ": "2 ", "two ": "2 ", "tres ": "3 ", "three ": "3 ",
+}
+
+var unicodeFractions = map[string]string{
+	"½": "1/2", "⅓": "1/3", "⅔": "2/3", "¼": "1/4", "¾": "3/4", "⅛": "1/8",
+}
+
+// Matches "1", "1.5", "1,5", "1/2", "1 1/2" and ranges like "2-3" at the start of the text
+var quantityRegex = regexp.MustCompile(`^\s*(\d+(?:[.,]\d+)?)(?:\s+(\d+)/(\d+)|/(\d+))?(?:\s*(?:-|a|to)\s*(\d+(?:[.,]\d+)?))?\s*(.*)$`)
+
+// ParseQuantity splits a free text quantity such as "200 g", "1/2 taza" or
+// "2-3 cucharadas" into a number and its unit (normalized, lowercase).
+// Ranges return their average. ok is false when no number is found
+// (e.g. "al gusto", "c/s").
+func ParseQuantity(q string) (amount float64, unit string, ok bool) {
+	q = strings.TrimSpace(q)
+	lower := strings.ToLower(q)
+	for word, number := range wordNumbers {
+		if strings.HasPrefix(lower, word) {
+			q = number + q[len(word):]
+			break
+		}
+	}
+	for symbol, fraction := range unicodeFractions {
+		q = strings.ReplaceAll(q, symbol, " "+fraction)
+	}
+
+	m := quantityRegex.FindStringSubmatch(strings.TrimSpace(q))
+	if m == nil {
+		return 0, NormalizeString(q), false
+	}
+
+	amount = parseDecimal(m[1])
+	switch {
+	case m[2] != "": // mixed number "1 1/2"
+		amount += parseDecimal(m[2]) / parseDecimal(m[3])
+	case m[4] != "": // simple fraction "1/2"
+		amount /= parseDecimal(m[4])
+	}
+	if m[5] != "" {
+		amount = (amount + parseDecimal(m[5])) / 2
+	}
+
+	unit = strings.Trim(NormalizeString(m[6]), " .")
+	return amount, unit, true
+}
+
+func parseDecimal(s string) float64 {
+	v, _ := strconv.ParseFloat(strings.Replace(s, ",", ".", 1), 64)
+	return v
+}
+
+// Units recognized when splitting an ingredient line
+const ingredientUnits = `kg|kilos?|gramos?|grs?|g|mg|litros?|l|ml|cl|dl|tazas?|vasos?|cucharadas?|cucharaditas?|cdas?|cdtas?|cditas?|cups?|tablespoons?|teaspoons?|tbsps?|tsps?|oz|ounces?|lbs?|pounds?|pizcas?|pinch(?:es)?|dientes?|cloves?|unidades?|latas?|cans?|sobres?|ramas?|ramitas?|hojas?|rodajas?|slices?|puñados?|handfuls?`
+
+const ingredientNumber = `(?:\d+(?:[.,]\d+)?(?:\s+\d+/\d+|/\d+)?\s*[½⅓⅔¼¾⅛]?|[½⅓⅔¼¾⅛])`
+
+// Matches "200 g de harina", "1/2 cup sugar", "2-3 huevos"
+var ingredientLineRegex = regexp.MustCompile(`(?i)^\s*(` + ingredientNumber + `(?:\s*(?:-|–|a|to)\s*` + ingredientNumber + `)?)\s*(?:(` + ingredientUnits + `)\.?(?:\s+|$))?(?:(?:de|of)\s+)?(.*)$`)
+
+// SplitIngredientLine splits a free text ingredient such as "200 g de harina"
+// into its quantity ("200 g") and item ("harina"). Lines without a leading
+// number are returned whole as the item.
+func SplitIngredientLine(line string) (quantity string, item string) {
+	line = strings.Join(strings.Fields(line), " ")
+	m := ingredientLineRegex.FindStringSubmatch(line)
+	if m == nil || strings.TrimSpace(m[3]) == "" {
+		return "", line
+	}
+	quantity = strings.TrimSpace(strings.TrimSpace(m[1]) + " " + m[2])
+	return quantity, strings.TrimSpace(m[3])
+}
@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Source is a video platform supported by the downloader.
+type Source struct {
+	Name     string   `json:"name"` // Stored in Recipe.Source
+	Label    string   `json:"label"`
+	Hosts    []string `json:"hosts"`
+	Examples []string `json:"examples"`
+
+	// DownloadArgs are extra yt-dlp options for this platform
+	DownloadArgs []string `json:"-"`
+
+	hostRegex    *regexp.Regexp   // Optional, for hosts with many domains (pinterest.es, pinterest.co.uk...)
+	idPatterns   []*regexp.Regexp // First submatch is the ID, tried in order
+	canonicalURL string           // Format with the ID
+}
+
+// MatchesHost reports whether a host (without port) belongs to the platform.
+func (s *Source) MatchesHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, h := range s.Hosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return s.hostRegex != nil && s.hostRegex.MatchString(host)
+}
+
+// ExtractID returns the video ID of a URL of this platform.
+func (s *Source) ExtractID(url string) (string, bool) {
+	for _, re := range s.idPatterns {
+		if match := re.FindStringSubmatch(url); len(match) > 1 {
+			return match[1], true
+		}
+	}
+	return "", false
+}
+
+// CanonicalURL returns the standard URL of a video from its ID.
+func (s *Source) CanonicalURL(id string) string {
+	return fmt.Sprintf(s.canonicalURL, id)
+}
+
+var sourceRegistry []*Source
+
+// RegisterSource adds a platform to the registry.
+func RegisterSource(s *Source) {
+	sourceRegistry = append(sourceRegistry, s)
+}
+
+// Sources returns the registered platforms.
+func Sources() []*Source {
+	return sourceRegistry
+}
+
+// FindSource returns a registered platform by name, or nil.
+func FindSource(name string) *Source {
+	for _, s := range sourceRegistry {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// SourceForHost returns the platform serving a host, or nil.
+func SourceForHost(host string) *Source {
+	for _, s := range sourceRegistry {
+		if s.MatchesHost(host) {
+			return s
+		}
+	}
+	return nil
+}
+
+func init() {
+	RegisterSource(&Source{
+		Name:     "youtube",
+		Label:    "YouTube",
+		Hosts:    []string{"youtube.com", "youtu.be", "youtube-nocookie.com"},
+		Examples: []string{"https://www.youtube.com/watch?v=ID", "https://www.youtube.com/shorts/ID", "https://youtu.be/ID", "https://www.youtube.com/live/ID", "https://www.youtube.com/embed/ID"},
+		// Watch URLs inside a playlist would download the whole list otherwise
+		DownloadArgs: []string{"--no-playlist"},
+		idPatterns: []*regexp.Regexp{
+			regexp.MustCompile(`youtube(?:-nocookie)?\.com/(?:shorts|live|embed|v)/([a-zA-Z0-9_-]+)`),
+			regexp.MustCompile(`[?&]v=([a-zA-Z0-9_-]+)`),
+			regexp.MustCompile(`youtu\.be/([a-zA-Z0-9_-]+)`),
+		},
+		canonicalURL: "https://www.youtube.com/watch?v=%s",
+	})
+
+	RegisterSource(&Source{
+		Name:     "instagram",
+		Label:    "Instagram",
+		Hosts:    []string{"instagram.com"},
+		Examples: []string{"https://www.instagram.com/reel/ID/", "https://www.instagram.com/p/ID/"},
+		idPatterns: []*regexp.Regexp{
+			regexp.MustCompile(`instagram\.com/(?:[\w.]+/)?(?:p|reel|reels|tv)/([a-zA-Z0-9_-]+)`),
+		},
+		canonicalURL: "https://www.instagram.com/p/%s/",
+	})
+
+	RegisterSource(&Source{
+		Name:     "tiktok",
+		Label:    "TikTok",
+		Hosts:    []string{"tiktok.com"},
+		Examples: []string{"https://www.tiktok.com/@user/video/ID"},
+		idPatterns: []*regexp.Regexp{
+			regexp.MustCompile(`tiktok\.com/.*/video/(\d+)`),
+			regexp.MustCompile(`tiktok\.com/embed(?:/v2)?/(\d+)`),
+		},
+		canonicalURL: "https://www.tiktok.com/@/video/%s",
+	})
+
+	RegisterSource(&Source{
+		Name:     "facebook",
+		Label:    "Facebook",
+		Hosts:    []string{"facebook.com", "fb.watch"},
+		Examples: []string{"https://www.facebook.com/reel/ID", "https://www.facebook.com/watch/?v=ID", "https://www.facebook.com/user/videos/ID"},
+		idPatterns: []*regexp.Regexp{
+			regexp.MustCompile(`facebook\.com/reels?/(\d+)`),
+			regexp.MustCompile(`facebook\.com/.*videos/(?:[^/?]+/)?(\d+)`),
+			regexp.MustCompile(`facebook\.com/.*[?&]v=(\d+)`),
+		},
+		canonicalURL: "https://www.facebook.com/watch/?v=%s",
+	})
+
+	RegisterSource(&Source{
+		Name:      "pinterest",
+		Label:     "Pinterest",
+		Hosts:     []string{"pinterest.com", "pin.it"},
+		Examples:  []string{"https://www.pinterest.com/pin/ID/"},
+		hostRegex: regexp.MustCompile(`(^|\.)pinterest\.[a-z]{2,3}(\.[a-z]{2})?$`),
+		idPatterns: []*regexp.Regexp{
+			regexp.MustCompile(`pinterest\.[a-z.]+/pin/(\d+)`),
+		},
+		canonicalURL: "https://www.pinterest.com/pin/%s/",
+	})
+
+	RegisterSource(&Source{
+		Name:     "vimeo",
+		Label:    "Vimeo",
+		Hosts:    []string{"vimeo.com"},
+		Examples: []string{"https://vimeo.com/ID", "https://player.vimeo.com/video/ID"},
+		idPatterns: []*regexp.Regexp{
+			regexp.MustCompile(`player\.vimeo\.com/video/(\d+)`),
+			regexp.MustCompile(`vimeo\.com/(?:[^?#]*/)?(\d+)(?:[/?#]|$)`),
+		},
+		canonicalURL: "https://vimeo.com/%s",
+	})
+
+	RegisterSource(&Source{
+		Name:     "x",
+		Label:    "X (Twitter)",
+		Hosts:    []string{"x.com", "twitter.com"},
+		Examples: []string{"https://x.com/user/status/ID"},
+		idPatterns: []*regexp.Regexp{
+			regexp.MustCompile(`(?:x|twitter)\.com/.*/status(?:es)?/(\d+)`),
+		},
+		canonicalURL: "https://x.com/i/status/%s",
+	})
+
+	RegisterSource(&Source{
+		Name:     "twitch",
+		Label:    "Twitch clips",
+		Hosts:    []string{"twitch.tv"},
+		Examples: []string{"https://clips.twitch.tv/SLUG", "https://www.twitch.tv/user/clip/SLUG"},
+		idPatterns: []*regexp.Regexp{
+			regexp.MustCompile(`clips\.twitch\.tv/(?:embed\?clip=)?([a-zA-Z0-9_-]+)`),
+			regexp.MustCompile(`twitch\.tv/[^/]+/clip/([a-zA-Z0-9_-]+)`),
+		},
+		canonicalURL: "https://clips.twitch.tv/%s",
+	})
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"regexp"
 	"strings"
 	"unicode"
 
@@ -18,3 +19,21 @@ func NormalizeString(s string) string {
 func isMn(r rune) bool {
 	return unicode.Is(unicode.Mn, r) // Mn: nonspacing marks (accents)
 }
+
+var hashtagRegex = regexp.MustCompile(`#([\p{L}\p{N}_]+)`)
+
+// ExtractHashtags returns the unique hashtags (without '#') found in a text, in order of appearance.
+func ExtractHashtags(text string) []string {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, match := range hashtagRegex.FindAllStringSubmatch(text, -1) {
+		tag := match[1]
+		key := NormalizeString(tag)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}